@@ -0,0 +1,149 @@
+package dnscache
+
+import (
+	"container/list"
+	"time"
+)
+
+// touch records that the given addr is fetched now, which is used by
+// `WithMaxEntryAge` and `WithCacheSize` options.
+func (r *Resolver) touch(addr string) {
+	if r.maxEntryAge <= 0 && r.maxEntries <= 0 {
+		return
+	}
+	now := r.now()
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	if r.maxEntryAge > 0 {
+		if r.lastAccess == nil {
+			r.lastAccess = make(map[string]time.Time)
+		}
+		r.lastAccess[addr] = now
+	}
+	if e, ok := r.lruEntries[addr]; ok {
+		r.lru.MoveToFront(e)
+	}
+}
+
+// admit adds the given addr newly added to the cache to the LRU list, and removes the
+// least recently fetched entries if the number of entries exceeds the max set by
+// `WithCacheSize` option. It returns the removed hosts. The caller must hold the lock.
+func (r *Resolver) admit(addr string) []string {
+	if r.maxEntries <= 0 {
+		return nil
+	}
+
+	r.accessLock.Lock()
+	if r.lru == nil {
+		r.lru = list.New()
+		r.lruEntries = make(map[string]*list.Element)
+	}
+	if e, ok := r.lruEntries[addr]; ok {
+		r.lru.MoveToFront(e)
+	} else {
+		r.lruEntries[addr] = r.lru.PushFront(addr)
+	}
+
+	var evicted []string
+	for r.lru.Len() > r.maxEntries {
+		oldest := r.lru.Remove(r.lru.Back()).(string)
+		delete(r.lruEntries, oldest)
+		evicted = append(evicted, oldest)
+	}
+	r.accessLock.Unlock()
+
+	for _, addr := range evicted {
+		r.deleteEntry(addr)
+	}
+	return evicted
+}
+
+// deleteEntry removes the entry of the given addr from the cache and forgets its state.
+// The caller must hold the lock.
+func (r *Resolver) deleteEntry(addr string) {
+	r.cache.Delete(addr)
+	delete(r.failures, addr)
+	delete(r.churn, addr)
+	if r.sched != nil {
+		r.sched.unschedule(addr)
+	}
+
+	r.accessLock.Lock()
+	delete(r.lastAccess, addr)
+	if e, ok := r.lruEntries[addr]; ok {
+		r.lru.Remove(e)
+		delete(r.lruEntries, addr)
+	}
+	r.accessLock.Unlock()
+
+	r.dialLock.Lock()
+	delete(r.rrCursors, addr)
+	delete(r.lastDialed, addr)
+	r.dialLock.Unlock()
+}
+
+// logEvicted logs the hosts removed from the cache by `WithCacheSize` option and
+// notifies them to the function set by `WithOnEvict` option.
+func (r *Resolver) logEvicted(evicted []string) {
+	for _, addr := range evicted {
+		r.log().Info("evicted least recently used host from DNS cache",
+			"addr", addr,
+		)
+		if r.onEvictFn != nil {
+			r.onEvictFn(addr)
+		}
+	}
+}
+
+// evictIdle removes the entries which have not been fetched for longer than the max
+// entry age set by `WithMaxEntryAge` option. The entries which have never been fetched,
+// e.g. loaded by `LoadFromFile`, are treated as fetched now.
+func (r *Resolver) evictIdle(now time.Time) {
+	if r.maxEntryAge <= 0 {
+		return
+	}
+
+	var evicted []string
+	r.lock.Lock()
+	r.accessLock.Lock()
+	if r.lastAccess == nil {
+		r.lastAccess = make(map[string]time.Time)
+	}
+	cached := make(map[string]struct{})
+	r.forEachEntry(func(addr string, entry *Entry) {
+		if entry.static {
+			return
+		}
+		last, ok := r.lastAccess[addr]
+		if !ok {
+			r.lastAccess[addr] = now
+			cached[addr] = struct{}{}
+			return
+		}
+		if now.Sub(last) > r.maxEntryAge {
+			evicted = append(evicted, addr)
+			return
+		}
+		cached[addr] = struct{}{}
+	})
+	// Forget the hosts removed from the cache by others.
+	for addr := range r.lastAccess {
+		if _, ok := cached[addr]; !ok {
+			delete(r.lastAccess, addr)
+		}
+	}
+	r.accessLock.Unlock()
+	for _, addr := range evicted {
+		r.deleteEntry(addr)
+	}
+	r.lock.Unlock()
+
+	for _, addr := range evicted {
+		r.log().Info("evicted idle host from DNS cache",
+			"addr", addr,
+		)
+		if r.onEvictFn != nil {
+			r.onEvictFn(addr)
+		}
+	}
+}
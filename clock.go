@@ -0,0 +1,58 @@
+package dnscache
+
+import "time"
+
+// Clock is the source of time used by the resolver. It can be replaced by
+// `WithClock` option to control time in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a new Ticker which ticks every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is a ticker created by Clock. It behaves like `time.Ticker`.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Reset stops the ticker and resets its period to d.
+	Reset(d time.Duration)
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// realClock is Clock which uses functions of `time` package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker is Ticker which wraps `time.Ticker`.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// clockOrDefault returns the clock of the resolver or the real clock if it is not set.
+func (r *Resolver) clockOrDefault() Clock {
+	if r.clock == nil {
+		return realClock{}
+	}
+	return r.clock
+}
+
+// now returns the current time by the clock of the resolver.
+func (r *Resolver) now() time.Time {
+	return r.clockOrDefault().Now()
+}
@@ -0,0 +1,878 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is Clock whose time is advanced manually by Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2018, 11, 13, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance advances the time by d and fires the tickers which are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || c.now.Before(t.next) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		t.next = c.now.Add(t.period)
+	}
+}
+
+// fakeTicker is Ticker created by fakeClock.
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.period = d
+	t.next = t.clock.now.Add(d)
+	t.stopped = false
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+func TestClock(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, time.Minute, nil
+	}
+
+	clock := newFakeClock()
+	refreshed := make(chan struct{})
+	resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithOnRefreshed(func() {
+			refreshed <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "clock.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	tick := func() {
+		t.Helper()
+		clock.Advance(10 * time.Second)
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second):
+			t.Fatalf("expect to be refreshed")
+		}
+	}
+
+	// TTL has not elapsed yet.
+	for i := 0; i < 5; i++ {
+		tick()
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect no refresh before TTL, called %d times", cnt)
+	}
+
+	// TTL has elapsed at 60s.
+	tick()
+	if cnt := atomic.LoadInt32(&called); cnt != 2 {
+		t.Fatalf("expect refresh after TTL, called %d times", cnt)
+	}
+}
+
+func TestIdleRefresh(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	refreshed := make(chan struct{})
+	resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithOnRefreshed(func() {
+			refreshed <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	tick := func() {
+		t.Helper()
+		clock.Advance(10 * time.Second)
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second):
+			t.Fatalf("expect to be refreshed")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		tick()
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 0 {
+		t.Fatalf("expect no lookup while the cache is empty, called %d times", cnt)
+	}
+
+	if _, err := resolver.Fetch(context.Background(), "idle.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tick()
+	if cnt := atomic.LoadInt32(&called); cnt != 2 {
+		t.Fatalf("expect refresh once the cache has an entry, called %d times", cnt)
+	}
+}
+
+func TestRefreshBounds(t *testing.T) {
+	cases := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{name: "BelowMin", ttl: time.Second},
+		{name: "AboveMax", ttl: time.Hour},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			originalFunc := lookupIP
+			defer func() {
+				lookupIP = originalFunc
+			}()
+
+			var called int32
+			lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+				atomic.AddInt32(&called, 1)
+				return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, tc.ttl, nil
+			}
+
+			clock := newFakeClock()
+			refreshed := make(chan struct{})
+			resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+				WithClock(clock),
+				WithRefreshBounds(30*time.Second, 30*time.Second),
+				WithOnRefreshed(func() {
+					refreshed <- struct{}{}
+				}),
+			)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer resolver.Stop()
+
+			if _, err := resolver.Fetch(context.Background(), "bounds.jp"); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			tick := func() {
+				t.Helper()
+				clock.Advance(10 * time.Second)
+				select {
+				case <-refreshed:
+				case <-time.After(time.Second):
+					t.Fatalf("expect to be refreshed")
+				}
+			}
+
+			for i := 0; i < 2; i++ {
+				tick()
+			}
+			if cnt := atomic.LoadInt32(&called); cnt != 1 {
+				t.Fatalf("expect no refresh before 30s, called %d times", cnt)
+			}
+
+			tick()
+			if cnt := atomic.LoadInt32(&called); cnt != 2 {
+				t.Fatalf("expect refresh at 30s, called %d times", cnt)
+			}
+		})
+	}
+}
+
+func TestNextRefresh(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu  sync.Mutex
+		ttl time.Duration
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, ttl, nil
+	}
+
+	clock := newFakeClock()
+	start := clock.Now()
+	refreshed := make(chan struct{})
+	resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithOnRefreshed(func() {
+			refreshed <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got := resolver.NextRefresh(); !got.IsZero() {
+		t.Fatalf("expect zero time while nothing is cached, got %v", got)
+	}
+
+	if _, err := resolver.Fetch(context.Background(), "unknown-ttl.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got, want := resolver.NextRefresh(), start.Add(10*time.Second); !got.Equal(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	clock.Advance(10 * time.Second)
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("expect to be refreshed")
+	}
+	if got, want := resolver.NextRefresh(), start.Add(20*time.Second); !got.Equal(want) {
+		t.Fatalf("want last tick + freq %v, got %v", want, got)
+	}
+
+	// The entry whose TTL elapses at 45s is refreshed at the tick of 50s.
+	mu.Lock()
+	ttl = 35 * time.Second
+	mu.Unlock()
+	resolver.Remove("unknown-ttl.jp")
+	if _, err := resolver.Fetch(context.Background(), "ttl.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got, want := resolver.NextRefresh(), start.Add(50*time.Second); !got.Equal(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	resolver.Stop()
+	<-resolver.Done()
+	if got := resolver.NextRefresh(); !got.IsZero() {
+		t.Fatalf("expect zero time after stop, got %v", got)
+	}
+}
+
+func TestPause(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		called  int32
+		resumed atomic.Bool
+		mu      sync.Mutex
+		hosts   = make(map[string]bool)
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		if resumed.Load() {
+			mu.Lock()
+			hosts[host] = true
+			mu.Unlock()
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	refreshed := make(chan struct{})
+	resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithOnRefreshed(func() {
+			refreshed <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "pause.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resolver.Pause()
+	resolver.Pause()
+	for i := 0; i < 3; i++ {
+		clock.Advance(10 * time.Second)
+		// Wait until the refresh goroutine receives the tick.
+		ticker := clock.tickers[0]
+		for deadline := time.Now().Add(time.Second); len(ticker.c) > 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expect tick to be received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect no refresh while paused, called %d times", cnt)
+	}
+	if !resolver.NextRefresh().IsZero() {
+		t.Fatalf("expect no next refresh while paused")
+	}
+
+	// Fetch works while paused.
+	if _, err := resolver.Fetch(context.Background(), "other.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The last tick may be handled after resume, which refreshes the hosts as well.
+	resumed.Store(true)
+	resolver.Resume()
+	resolver.Resume()
+	clock.Advance(10 * time.Second)
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("expect to be refreshed after resume")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !hosts["pause.jp"] || !hosts["other.jp"] {
+		t.Fatalf("expect both hosts to be refreshed after resume, got %v", hosts)
+	}
+}
+
+func TestStopAbortsRefresh(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		called  int32
+		started = make(chan struct{}, 1)
+		block   atomic.Bool
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if !block.Load() {
+			return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+		}
+		atomic.AddInt32(&called, 1)
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(10*time.Second, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for _, host := range []string{"a.jp", "b.jp", "c.jp"} {
+		if _, err := resolver.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	block.Store(true)
+	clock.Advance(10 * time.Second)
+	<-started
+	resolver.Stop()
+
+	select {
+	case <-resolver.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expect the refresh in progress to be aborted")
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect the rest of hosts not to be looked up, called %d times", cnt)
+	}
+}
+
+func TestBackgroundRefresh(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		called  int32
+		blocked atomic.Bool
+		release = make(chan struct{})
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		if !blocked.Load() {
+			return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 10 * time.Second, nil
+		}
+		<-release
+		return []net.IPAddr{{IP: net.IP("10.0.0.2")}}, 10 * time.Second, nil
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithBackgroundRefresh(true),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "bg.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := resolver.Fetch(context.Background(), "bg.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect no refresh before TTL elapses, called %d times", cnt)
+	}
+
+	// The stale IPs are returned without waiting for the blocked lookup.
+	blocked.Store(true)
+	clock.Advance(11 * time.Second)
+	for i := 0; i < 3; i++ {
+		ips, err := resolver.Fetch(context.Background(), "bg.jp")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if want := []net.IP{net.IP("10.0.0.1")}; !reflect.DeepEqual(ips, want) {
+			t.Fatalf("want stale %v, got %v", want, ips)
+		}
+	}
+	close(release)
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		ips, _ := resolver.Fetch(context.Background(), "bg.jp")
+		if reflect.DeepEqual(ips, []net.IP{net.IP("10.0.0.2")}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect the cache to be refreshed in background, got %v", ips)
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 2 {
+		t.Fatalf("expect one background refresh, called %d times", cnt)
+	}
+}
+
+func TestBackgroundRefreshStop(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		blocked  atomic.Bool
+		started  = make(chan struct{})
+		canceled = make(chan struct{})
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if !blocked.Load() {
+			return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 10 * time.Second, nil
+		}
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, 0, ctx.Err()
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(time.Hour, time.Hour,
+		WithClock(clock),
+		WithBackgroundRefresh(true),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "bg.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	blocked.Store(true)
+	clock.Advance(11 * time.Second)
+	if _, err := resolver.Fetch(context.Background(), "bg.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	<-started
+
+	resolver.Stop()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("expect the background refresh to be canceled by Stop")
+	}
+
+	// The refresh canceled by Stop is not the failure of the host.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := resolver.bgRefreshing.Load("bg.jp"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect the background refresh to finish")
+		}
+	}
+	if got := resolver.Stats().RefreshFailures; got != 0 {
+		t.Fatalf("want no refresh failure, got %d", got)
+	}
+}
+
+func TestLookupRetriesClock(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if atomic.AddInt32(&called, 1) == 1 {
+			return nil, 0, &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithLookupRetries(1, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := resolver.LookupIP(context.Background(), "retry.jp")
+		errCh <- err
+	}()
+
+	// The backoff waits for the clock, not the wall time.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		clock.Advance(time.Minute)
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect the retry after the backoff by the clock")
+		}
+	}
+}
+
+func TestMaxEntryAge(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	refreshed := make(chan struct{})
+	resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithMaxEntryAge(25*time.Second),
+		WithStaticEntries(map[string][]net.IP{
+			"static.jp": {net.IP("10.0.0.2")},
+		}),
+		WithOnRefreshed(func() {
+			refreshed <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	tick := func() {
+		t.Helper()
+		clock.Advance(10 * time.Second)
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second):
+			t.Fatalf("expect to be refreshed")
+		}
+	}
+
+	for _, host := range []string{"idle.jp", "active.jp"} {
+		if _, err := resolver.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		tick()
+		if _, err := resolver.Fetch(context.Background(), "active.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	entries := resolver.Entries()
+	if _, ok := entries["idle.jp"]; ok {
+		t.Fatalf("expect idle host to be evicted")
+	}
+	for _, host := range []string{"active.jp", "static.jp"} {
+		if _, ok := entries[host]; !ok {
+			t.Fatalf("expect %s to be kept", host)
+		}
+	}
+}
+
+func TestMaxStaleAge(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var fail atomic.Bool
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if fail.Load() {
+			return nil, 0, errors.New("err")
+		}
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	var (
+		mu      sync.Mutex
+		evicted []string
+	)
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithMaxStaleAge(time.Minute),
+		WithOnStaleEvict(func(host string) {
+			mu.Lock()
+			evicted = append(evicted, host)
+			mu.Unlock()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "stale.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A successful refresh within the max stale age resets the age.
+	fail.Store(true)
+	clock.Advance(40 * time.Second)
+	resolver.Refresh()
+	fail.Store(false)
+	resolver.Refresh()
+	fail.Store(true)
+	clock.Advance(40 * time.Second)
+	resolver.Refresh()
+	if _, ok := resolver.Peek("stale.jp"); !ok {
+		t.Fatalf("expect refreshed entry to be kept")
+	}
+
+	// The entry is dropped once it is stale past the max stale age.
+	clock.Advance(30 * time.Second)
+	resolver.Refresh()
+	// The further failures do not notify again.
+	resolver.Refresh()
+	if _, ok := resolver.Peek("stale.jp"); ok {
+		t.Fatalf("expect stale entry to be dropped")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"stale.jp"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("want %v, got %v", want, evicted)
+	}
+}
+
+func TestInitialDelay(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	start := clock.Now()
+	refreshed := make(chan struct{})
+	resolver, err := New(10*time.Second, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithInitialDelay(25*time.Second),
+		WithOnRefreshed(func() {
+			refreshed <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	// The host is looked up on Fetch during the delay.
+	if _, err := resolver.Fetch(context.Background(), "delay.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got, want := resolver.NextRefresh(), start.Add(35*time.Second); !got.Equal(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(10 * time.Second)
+		select {
+		case <-refreshed:
+			t.Fatalf("expect not to be refreshed before the delay, refreshed at %v", clock.Now().Sub(start))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect to be looked up only by Fetch, called %d times", cnt)
+	}
+
+	// The first refresh happens at 35s, and then every 10s.
+	for _, d := range []time.Duration{5 * time.Second, 10 * time.Second} {
+		clock.Advance(d)
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second):
+			t.Fatalf("expect to be refreshed at %v", clock.Now().Sub(start))
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 3 {
+		t.Fatalf("expect to be refreshed twice, called %d times", cnt)
+	}
+}
+
+func TestFetchWithTTL(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "unknown-ttl.jp" {
+			return []net.IPAddr{{IP: net.IP("10.0.0.2")}}, 0, nil
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 30 * time.Second, nil
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(time.Minute, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithStaticEntries(map[string][]net.IP{
+			"static.jp": {net.IP("10.0.0.3")},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	fetch := func(host string) time.Duration {
+		t.Helper()
+		_, ttl, err := resolver.FetchWithTTL(context.Background(), host)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return ttl
+	}
+
+	if got := fetch("ttl.jp"); got != 30*time.Second {
+		t.Fatalf("want 30s, got %v", got)
+	}
+	if got := fetch("unknown-ttl.jp"); got != time.Minute {
+		t.Fatalf("expect the refresh frequency for the unknown TTL, got %v", got)
+	}
+
+	clock.Advance(10 * time.Second)
+	if got := fetch("ttl.jp"); got != 20*time.Second {
+		t.Fatalf("want 20s, got %v", got)
+	}
+	if got := fetch("unknown-ttl.jp"); got != 50*time.Second {
+		t.Fatalf("want 50s, got %v", got)
+	}
+
+	// The stale entry is served with the non-positive TTL until it is refreshed.
+	clock.Advance(25 * time.Second)
+	if got := fetch("ttl.jp"); got != -5*time.Second {
+		t.Fatalf("want -5s, got %v", got)
+	}
+
+	for _, host := range []string{"static.jp", "10.0.0.4"} {
+		if got := fetch(host); got != time.Duration(math.MaxInt64) {
+			t.Fatalf("%s: expect never to be refreshed, got %v", host, got)
+		}
+	}
+}
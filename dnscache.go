@@ -1,16 +1,38 @@
 package dnscache
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"log/slog"
+	"math"
+	"math/rand/v2"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
 const (
 	// cacheSize is initial size of addr and IP list cache map.
 	cacheSize = 64
+
+	// warmupConcurrency is the number of initial hosts looked up concurrently.
+	warmupConcurrency = 8
+
+	// fetchManyConcurrency is the number of hosts looked up concurrently by `FetchMany`.
+	fetchManyConcurrency = 8
+
+	// healthCheckConcurrency is the number of IPs probed concurrently by the health check.
+	healthCheckConcurrency = 8
 )
 
 // defaultFreq is default frequency a resolver refreshes DNS cache.
@@ -19,43 +41,410 @@ var (
 	defaultLookupTimeout = 10 * time.Second
 )
 
-// lookupIP is a wrapper of net.DefaultResolver.LookupIPAddr.
-// This is used to replace lookup function when test.
-var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
-	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
-	if err != nil {
-		return nil, err
+// lookupIP lookups IP list and its TTL of the given host. It queries the
+// nameservers in the system resolver configuration to get the TTL. If they can not
+// be queried directly in the same way as the system resolver, i.e. the configuration
+// is not available, the host is in the hosts file or the name service switch consults
+// other sources, it lookups by net.DefaultResolver.LookupIPAddr instead and the returned
+// TTL is 0, which means unknown. The configuration and the hosts file are reloaded when
+// they change. This is used to replace lookup function when test.
+var lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if conf := systemConf.clientConfig(host); conf != nil {
+		ips, ttl, err := lookupIPWithTTL(ctx, conf, host)
+		return ipAddrsOf(ips), ttl, err
 	}
 
-	ips := make([]net.IP, len(addrs))
-	for i, ia := range addrs {
-		ips[i] = ia.IP
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	return addrs, 0, err
+}
+
+// onRefreshed is called when DNS are refreshed. It is used unless
+// `WithOnRefreshed` option is set.
+var onRefreshed = func() {}
+
+// Entry is a cached DNS resolve result of a host, which is kept in `Store`.
+// It is never modified once it is stored. It can be serialized as JSON
+// to keep it outside of memory.
+type Entry struct {
+	ips []net.IP
+
+	// expireAt is the time when the TTL of the records elapses.
+	// Zero value means the TTL is unknown.
+	expireAt time.Time
+
+	// static is true if the entry is given by `WithStaticEntries` option.
+	// Static entries are never refreshed nor looked up.
+	static bool
+
+	// refreshedAt is the time when the entry was looked up successfully.
+	refreshedAt time.Time
+
+	// canonicalName is the canonical name of the host captured by
+	// `WithCanonicalName` option.
+	canonicalName string
+
+	// invalidated is true if the entry is invalidated by `Invalidate`.
+	// Invalidated entries are looked up again on the next `Fetch`.
+	invalidated bool
+
+	// zones is the zones of the IPv6 addresses (e.g. "eth0" of a link-local address)
+	// keyed by ipKey. It is nil if no address has a zone.
+	zones map[string]string
+}
+
+// meta returns `FetchMeta` of the entry.
+func (e *Entry) meta(hit bool) FetchMeta {
+	return FetchMeta{Hit: hit, LastRefreshed: e.refreshedAt, CanonicalName: e.canonicalName}
+}
+
+// zone returns the zone of the given IP, or the empty string if it has no zone.
+// It is safe to call it with a nil entry.
+func (e *Entry) zone(ip net.IP) string {
+	if e == nil || e.zones == nil {
+		return ""
 	}
+	return e.zones[ipKey(ip)]
+}
 
-	return ips, nil
+// expired reports whether the TTL of the entry has elapsed at the given time.
+func (e *Entry) expired(now time.Time) bool {
+	return !now.Before(e.expireAt)
 }
 
-// onRefreshed is called when DNS are refreshed.
-var onRefreshed = func() {}
+// LookupError is an error of DNS lookup of the host. It is returned
+// by `LookupIP` and `Fetch`.
+type LookupError struct {
+	Host string
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	return "dnscache: failed to lookup " + e.Host + ": " + e.Err.Error()
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+// negativeEntry is a cached failure of DNS lookup.
+type negativeEntry struct {
+	err      error
+	expireAt time.Time
+}
+
+// isNotFound reports whether the given error means the host does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// DNSCache is the interface of DNS cache resolver. `*Resolver` implements it.
+// Depend on this interface instead of `*Resolver` to inject a mock.
+type DNSCache interface {
+	LookupIP(ctx context.Context, addr string) ([]net.IP, error)
+	LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error)
+	Fetch(ctx context.Context, addr string) ([]net.IP, error)
+	FetchWithMeta(ctx context.Context, addr string) ([]net.IP, FetchMeta, error)
+	FetchInto(ctx context.Context, addr string, dst []net.IP) ([]net.IP, error)
+	FetchOne(ctx context.Context, addr string) (net.IP, error)
+	FetchNetwork(ctx context.Context, network, addr string) ([]net.IP, error)
+	FetchWithTTL(ctx context.Context, addr string) ([]net.IP, time.Duration, error)
+	FetchMany(ctx context.Context, hosts []string) (map[string][]net.IP, error)
+	Peek(addr string) ([]net.IP, bool)
+	Refresh()
+	RefreshContext(ctx context.Context) error
+	RefreshHost(ctx context.Context, addr string) error
+	Remove(addr string)
+	Invalidate(addr string)
+	Clear()
+	Len() int
+	Compact()
+	Entries() map[string][]net.IP
+	Dump() string
+	Warmup(ctx context.Context, hosts ...string) error
+	SaveToFile(path string) error
+	LoadFromFile(path string) error
+	Stats() Stats
+	ResetStats()
+	PublishExpvar(name string) error
+	HostStats(host string) HostStats
+	Ready() <-chan struct{}
+	NextRefresh() time.Time
+	Done() <-chan struct{}
+	IsRunning() bool
+	SetLogger(logger *slog.Logger)
+	Pause()
+	Resume()
+	Stop()
+}
+
+var _ DNSCache = (*Resolver)(nil)
+
+// isRetryable reports whether the lookup failed by the given error may succeed on retry,
+// i.e. it is a timeout or temporary error other than that the host does not exist.
+func isRetryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
 
 // Resolver is DNS cache resolver which cache DNS resolve results in memory.
+//
+// The cache entries are never modified once they are stored in the cache.
+// To update an entry, replace it with a new one.
 type Resolver struct {
-	lookupIPFn    func(ctx context.Context, host string) ([]net.IP, error)
-	lookupTimeout time.Duration
+	lookupIPFn func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
 
+	// dialLookupTimeout is used when DialFunc lookups DNS
+	dialLookupTimeout time.Duration
+
+	// lock guards the cache and the other maps below. The cache store is accessed with
+	// it held, except that the default sharded store is read without it by getEntry. The
+	// store set by `WithStore` option is always read with it held, so the sharding only
+	// helps the default store.
 	lock  sync.RWMutex
-	cache map[string][]net.IP
+	cache Store
+
+	lookupSRVFn func(ctx context.Context, service, proto, name string) ([]*net.SRV, error)
+
+	lookupCNAMEFn func(ctx context.Context, host string) (string, error)
+
+	// captureCNAME makes lookups capture the canonical names.
+	captureCNAME bool
+
+	// srvCache is the cache of SRV records keyed by the looked up name.
+	srvCache map[string]*srvEntry
+
+	// maxStale is how long an entry which fails to refresh is kept serving.
+	// Zero means forever.
+	maxStale time.Duration
+
+	// onStaleEvictFn is called when an entry is dropped since it is stale for longer
+	// than maxStale.
+	onStaleEvictFn func(host string)
+
+	// failures is the refresh failures of each host. It is protected by lock.
+	failures map[string]hostFailures
+
+	// removeThreshold is the number of consecutive refresh failures to remove
+	// the host from the cache. Zero disables it.
+	removeThreshold int
+
+	// evictOnErr reports whether the refresh error counts toward removing the host.
+	// Nil means only not-found errors count.
+	evictOnErr func(err error) bool
+
+	// negCache is the cache of failed lookups. It is protected by lock.
+	negCache map[string]negativeEntry
+
+	// negativeTTL is how long failed lookups are cached. Zero disables it.
+	negativeTTL time.Duration
+
+	// group collapses concurrent lookups of the same addr.
+	group singleflight.Group
+
+	// rand is the random source set by `WithRandSource`. Nil means the global source.
+	rand     *rand.Rand
+	randLock sync.Mutex
+
+	// dialStrategy decides the order of IPs to dial in DialFunc.
+	dialStrategy DialStrategy
+
+	// ipOrderer decides the order of IPs to dial in DialFunc instead of
+	// dialStrategy if it is set.
+	ipOrderer IPOrderer
+
+	// hostAllowlist is the hosts which are cached. Nil means all hosts.
+	hostAllowlist []hostPattern
 
-	// defaultLookupTimeout is used when refreshing DNS cache
-	defaultLookupTimeout time.Duration
-	logger               *slog.Logger
+	// hostDenylist is the hosts which are not cached.
+	hostDenylist []hostPattern
 
-	closer func()
+	// dialTraceFn is called after every dial attempt of DialFunc.
+	dialTraceFn func(host string, ip net.IP, err error, took time.Duration)
+
+	// dialFallback makes DialFunc dial the host by the base dial function
+	// when no IP is left to dial.
+	dialFallback bool
+
+	// dialAttemptTimeout is the timeout of dialing each IP in DialFunc. Zero means
+	// no timeout other than the base dial function's one.
+	dialAttemptTimeout time.Duration
+
+	// dialLock protects rrCursors and lastDialed. It is acquired after lock if both are
+	// needed.
+	dialLock sync.Mutex
+
+	// rrCursors is the next IP index to dial first for each host
+	// when the dial strategy is RoundRobin.
+	rrCursors map[string]int
+
+	// lastDialed is the last IP dialed successfully for each host
+	// when the dial strategy is PreferLastSuccessful.
+	lastDialed map[string]net.IP
+
+	// retries is the number of retries of the lookup failed by a transient error.
+	retries int
+
+	// retryBackoff is the initial backoff between retries.
+	retryBackoff time.Duration
+
+	// ipFilters are the predicates which IPs must satisfy to be cached.
+	ipFilters []func(net.IP) bool
+
+	// maxIPs is the max number of IPs cached per host. Zero means no limit.
+	maxIPs int
+
+	// family is the IP family to cache.
+	family IPFamily
+
+	// fixedFreq makes Refresh re-resolve all entries regardless of their TTL.
+	fixedFreq bool
+
+	// minRefresh and maxRefresh clamp the TTL used to decide when an entry is refreshed.
+	minRefresh time.Duration
+	maxRefresh time.Duration
+
+	// refreshJitter is the fraction of freq to randomize the refresh interval.
+	refreshJitter float64
+
+	// stableSort makes the cached IPs sorted by their bytes.
+	stableSort bool
+
+	// initialDelay delays the first refresh.
+	initialDelay time.Duration
+
+	// sched schedules the refresh of each host by its TTL instead of the ticks of freq
+	// if it is set by WithExpiryScheduler.
+	sched *scheduler
+
+	// refreshConcurrency is the number of hosts refreshed concurrently.
+	refreshConcurrency int
+
+	// refreshLookupTimeout is used when refreshing DNS cache
+	refreshLookupTimeout time.Duration
+
+	// hostTimeouts overrides the lookup timeout of specific hosts.
+	hostTimeouts map[string]time.Duration
+
+	// logger is the logger set by `WithLogger` option or `SetLogger`. Nil means
+	// `slog.Default()`.
+	logger atomic.Pointer[slog.Logger]
+
+	counters counters
+
+	// onRefreshedFn is called when the cache is refreshed by the refresh goroutine.
+	onRefreshedFn func()
+
+	// onIPsChangedFn is called when the IP set of a cached host changes.
+	onIPsChangedFn func(host string, added, removed []net.IP)
+
+	// onChurnFn is called when the IP set of a host changes churnThreshold times or more
+	// within a refresh window. churn is the number of the changes of each host in the
+	// current window, which is protected by lock.
+	onChurnFn      func(host string, changes int)
+	churnThreshold int
+	churn          map[string]int
+
+	// onLookupErrorFn is called when a DNS lookup fails.
+	onLookupErrorFn func(host string, err error)
+
+	// clock is the source of time. Nil means the real clock.
+	clock Clock
+
+	// maxEntryAge is how long an entry is kept without being fetched. Zero means forever.
+	maxEntryAge time.Duration
+
+	// lastAccess is when each host was fetched last. It is guarded by accessLock,
+	// which is acquired after lock if both are needed.
+	lastAccess map[string]time.Time
+	accessLock sync.Mutex
+
+	// maxEntries is the max number of non-static entries set by `WithCacheSize` option.
+	// Zero means no limit.
+	maxEntries int
+
+	// lru orders the non-static hosts from the most recently fetched when maxEntries is set.
+	// It is guarded by accessLock.
+	lru        *list.List
+	lruEntries map[string]*list.Element
+
+	// onEvictFn is called when an entry is evicted by maxEntryAge or maxEntries.
+	onEvictFn func(host string)
+
+	// maxLoadAge is the max age of the entries loaded by `LoadFromFile`. Zero means no limit.
+	maxLoadAge time.Duration
+
+	// limiter limits the rate of DNS queries if it is set.
+	limiter *rate.Limiter
+
+	// lookupSem limits the number of concurrent DNS queries if it is set.
+	lookupSem *semaphore.Weighted
+
+	// backgroundRefresh makes Fetch refresh the expired entry in background.
+	backgroundRefresh bool
+
+	// bgRefreshing is the set of the hosts being refreshed in background.
+	bgRefreshing sync.Map
+
+	// healthInterval and healthProbe are set by `WithHealthCheck` option.
+	healthInterval time.Duration
+	healthProbe    func(ctx context.Context, ip net.IP) bool
+
+	// unhealthy is the set of the IPs (keyed by ipKey) which failed the last health check.
+	unhealthy atomic.Pointer[map[string]struct{}]
+
+	// initialHosts are looked up when the resolver starts.
+	initialHosts []string
+
+	// blockingWarmup makes New wait until the initial hosts are looked up.
+	blockingWarmup bool
+
+	// ready is closed when the initial hosts are looked up.
+	ready chan struct{}
+
+	// paused makes the refresh goroutine skip refreshing.
+	paused atomic.Bool
+
+	// freq is the frequency of auto refreshing.
+	freq time.Duration
+
+	// nextTick is when the refresh ticker fires next. It is guarded by lock.
+	nextTick time.Time
+
+	// stop is closed by `Stop` to stop auto refreshing.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// done is closed when auto refreshing has stopped.
+	done chan struct{}
+
+	// ctx is cancelled when the resolver is stopped by `Stop` or the cancellation of the
+	// context given to `NewWithContext`. Nil means it is never cancelled.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // New initializes DNS cache resolver and starts auto refreshing in a new goroutine.
 // To stop refreshing, call `Stop()` function.
+//
+// Every freq, the resolver re-resolves the cached entries whose TTL has elapsed.
+// Entries whose TTL is unknown are re-resolved every time. To re-resolve all
+// entries every freq regardless of TTL, use `WithFixedFrequency` option.
+//
+// lookupTimeout is used for both refreshing and the lookup in `DialFunc`.
+// To use a different timeout for `DialFunc`, use `WithDialLookupTimeout` option.
+// It also bounds the DNS lookups shared by concurrent `Fetch` and `LookupIP` calls.
 func New(freq time.Duration, lookupTimeout time.Duration, options ...Option) (*Resolver, error) {
+	return NewWithContext(context.Background(), freq, lookupTimeout, options...), nil
+}
+
+// NewWithContext initializes DNS cache resolver like `New`. Auto refreshing is stopped
+// when the given context is done or `Stop()` is called.
+func NewWithContext(ctx context.Context, freq time.Duration, lookupTimeout time.Duration, options ...Option) *Resolver {
 	if freq <= 0 {
 		freq = defaultFreq
 	}
@@ -64,98 +453,1281 @@ func New(freq time.Duration, lookupTimeout time.Duration, options ...Option) (*R
 		lookupTimeout = defaultLookupTimeout
 	}
 
-	ticker := time.NewTicker(freq)
-	ch := make(chan struct{})
-	closer := func() {
-		ticker.Stop()
-		close(ch)
-	}
-
 	// copy handler function to avoid race
 	onRefreshedFn := onRefreshed
 	lookupIPFn := lookupIP
 
 	r := &Resolver{
 		lookupIPFn:           lookupIPFn,
-		lookupTimeout:        lookupTimeout,
-		cache:                make(map[string][]net.IP, cacheSize),
-		defaultLookupTimeout: lookupTimeout,
-		logger:               slog.Default(),
-		closer:               closer,
+		lookupSRVFn:          lookupSRV,
+		lookupCNAMEFn:        lookupCNAME,
+		dialLookupTimeout:    lookupTimeout,
+		cache:                newShardedStore(cacheShards),
+		refreshLookupTimeout: lookupTimeout,
+		refreshConcurrency:   1,
+		onRefreshedFn:        onRefreshedFn,
+		ready:                make(chan struct{}),
+		stop:                 make(chan struct{}),
+		done:                 make(chan struct{}),
 	}
 
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
 	for _, o := range options {
 		o.apply(r)
 	}
 
+	interval := freq
+	if r.refreshJitter > 0 {
+		interval = r.refreshInterval(freq)
+	}
+	r.freq = freq
+	// The first tick is delayed, and then the ticker is reset to the interval.
+	delayed := r.initialDelay > 0
+	ticker := r.clockOrDefault().NewTicker(interval + r.initialDelay)
+	r.setNextTick(r.now().Add(interval + r.initialDelay))
+
+	if r.blockingWarmup {
+		r.warmup(r.initialHosts)
+		close(r.ready)
+	}
+
+	if r.healthProbe != nil {
+		// The root context aborts the probes in progress when the resolver is stopped.
+		go r.runHealthCheck(r.ctx, r.clockOrDefault().NewTicker(r.healthInterval))
+	}
+
 	go func() {
+		defer close(r.done)
+		defer ticker.Stop()
+
+		// refreshCtx aborts the refresh in progress when the resolver is stopped. It is
+		// derived from the root context so that it is done as soon as the shared lookups
+		// are canceled by `Stop`.
+		refreshCtx, cancelRefresh := context.WithCancel(r.ctx)
+		defer cancelRefresh()
+		if r.sched != nil {
+			schedDone := make(chan struct{})
+			go func() {
+				defer close(schedDone)
+				r.runScheduler(refreshCtx)
+			}()
+			// Wait for the scheduler to stop before closing done.
+			defer func() {
+				cancelRefresh()
+				<-schedDone
+			}()
+		}
+		go func() {
+			select {
+			case <-r.stop:
+				cancelRefresh()
+			case <-refreshCtx.Done():
+			}
+		}()
+
+		if !r.blockingWarmup {
+			r.warmup(r.initialHosts)
+			close(r.ready)
+		}
+
 		for {
 			select {
-			case <-ticker.C:
-				r.Refresh()
-				onRefreshedFn()
-			case <-ch:
+			case <-ticker.C():
+				interval := freq
+				if r.refreshJitter > 0 {
+					interval = r.refreshInterval(freq)
+				}
+				if r.refreshJitter > 0 || delayed {
+					ticker.Reset(interval)
+					delayed = false
+				}
+				r.setNextTick(r.now().Add(interval))
+
+				if r.paused.Load() {
+					continue
+				}
+				if !r.idle() {
+					// The scheduler refreshes the IP lists by itself.
+					_ = r.refresh(refreshCtx, r.sched == nil)
+				}
+				r.onRefreshedFn()
+			case <-ctx.Done():
+				return
+			case <-r.stop:
 				return
 			}
 		}
 	}()
 
-	return r, nil
+	return r
+}
+
+// idle reports whether there is nothing to refresh, i.e. none of the cache,
+// the negative cache and the SRV cache has an entry.
+func (r *Resolver) idle() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cache.Len() == 0 && len(r.negCache) == 0 && len(r.srvCache) == 0
+}
+
+// Warmup lookups the given hosts concurrently and saves the results in the cache, e.g. to
+// prepare a new backend before using it. Each lookup is cancelled by the given context or
+// the refresh lookup timeout. The hosts looked up successfully are cached even if the others
+// fail, and it returns the joined errors of the failed hosts. It is safe to call it repeatedly
+// and the cached hosts are looked up again.
+func (r *Resolver) Warmup(ctx context.Context, hosts ...string) error {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	forEachConcurrently(hosts, warmupConcurrency, func(host string) {
+		ctx, cancelF := context.WithTimeout(ctx, r.lookupTimeout(host, r.refreshLookupTimeout))
+		defer cancelF()
+		if _, err := r.LookupIP(ctx, host); err != nil {
+			r.log().Error("failed to warm up DNS cache",
+				"error", err,
+				"addr", host,
+			)
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// warmup lookups the initial hosts given by `WithInitialHosts` option. Failures are logged.
+func (r *Resolver) warmup(hosts []string) {
+	_ = r.Warmup(context.Background(), hosts...)
+}
+
+// setNextTick records when the refresh ticker fires next.
+func (r *Resolver) setNextTick(t time.Time) {
+	r.lock.Lock()
+	r.nextTick = t
+	r.lock.Unlock()
+}
+
+// NextRefresh returns when the next refresh will occur. Since only the entries whose TTL
+// has elapsed are refreshed (unless `WithFixedFrequency` option is set), it is the first
+// tick of the refresh ticker at or after the soonest TTL expiry of the cached entries,
+// assuming the ticker fires every freq. With `WithExpiryScheduler` option, it is the earliest
+// deadline of the scheduled hosts. If auto refreshing has stopped or is paused, or nothing
+// is cached, it returns the zero time.
+func (r *Resolver) NextRefresh() time.Time {
+	if !r.IsRunning() || r.paused.Load() {
+		return time.Time{}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	// SRV records are refreshed on every tick.
+	if len(r.srvCache) > 0 {
+		if r.sched != nil {
+			if at, ok := r.sched.next(); ok && at.Before(r.nextTick) {
+				return at
+			}
+		}
+		return r.nextTick
+	}
+	if r.sched != nil {
+		at, _ := r.sched.next()
+		return at
+	}
+
+	var (
+		soonest time.Time
+		found   bool
+	)
+	r.forEachEntry(func(addr string, entry *Entry) {
+		if entry.static {
+			return
+		}
+		expireAt := entry.expireAt
+		if r.fixedFreq || entry.invalidated {
+			expireAt = time.Time{}
+		}
+		if !found || expireAt.Before(soonest) {
+			soonest = expireAt
+			found = true
+		}
+	})
+	if !found {
+		return time.Time{}
+	}
+
+	next := r.nextTick
+	if soonest.After(next) {
+		ticks := (soonest.Sub(next) + r.freq - 1) / r.freq
+		next = next.Add(ticks * r.freq)
+	}
+	return next
+}
+
+// Ready returns a channel which is closed when the resolver finishes looking up
+// the initial hosts given by `WithInitialHosts` option. If no initial host is given,
+// it is closed soon after the resolver starts.
+func (r *Resolver) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// refreshInterval returns the interval until the next refresh, which is
+// randomized by up to ±refreshJitter of freq.
+func (r *Resolver) refreshInterval(freq time.Duration) time.Duration {
+	jitter := (r.float64()*2 - 1) * r.refreshJitter * float64(freq)
+	if interval := freq + time.Duration(jitter); interval > 0 {
+		return interval
+	}
+	return freq
 }
 
 // LookupIP lookups IP list from DNS server then it saves result in the cache.
 // If you want to get result from the cache use `Fetch` function.
+// The addr is case-insensitive and a trailing dot is ignored. The internationalized domain name
+// is looked up and cached in the ASCII form, so it shares the entry with its punycode form.
+// If addr has a port like "example.com:443" or "[::1]:443", the port is ignored.
+// For the static entries, it returns the IP list without DNS lookup.
+// If addr is an IP address, it returns the IP without DNS lookup nor caching.
+// Concurrent calls for the same addr share one DNS lookup and its result. The shared lookup
+// is not cancelled by the context of any caller but by the lookup timeout (or the latest
+// deadline of the first caller if it is later) and `Stop`, while each caller stops waiting
+// for it when its own context is done.
 func (r *Resolver) LookupIP(ctx context.Context, addr string) ([]net.IP, error) {
-	ips, err := r.lookupIPFn(ctx, addr)
+	if err := validateHost(addr); err != nil {
+		return nil, err
+	}
+	addr = NormalizeHost(addr)
+	if ip := parseIPLiteral(addr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r.bypassCache(ctx, addr) {
+		return r.lookupUncached(ctx, addr)
+	}
+
+	cached, ok := r.getEntry(addr)
+	if ok && cached.static {
+		return copyIPs(cached.ips), nil
+	}
+
+	ch := r.group.DoChan(addr, func() (interface{}, error) {
+		lookupCtx, cancelF := r.sharedContext(ctx, addr)
+		defer cancelF()
+		return r.lookup(lookupCtx, addr)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return copyIPs(res.Val.([]net.IP)), nil
+	case <-ctx.Done():
+		return nil, &LookupError{Host: addr, Err: ctx.Err()}
+	}
+}
+
+// sharedContext returns the context of the lookup of the given host shared by concurrent
+// callers. It keeps the values of the given context of the first caller but is not cancelled
+// by it, so that the caller giving up does not fail the others. Instead, it is cancelled by
+// the lookup timeout of the host, extended to the deadline of the given context if it is
+// later, or when the resolver is stopped.
+func (r *Resolver) sharedContext(ctx context.Context, host string) (context.Context, context.CancelFunc) {
+	timeout := r.lookupTimeout(host, r.refreshLookupTimeout)
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); d > timeout {
+			timeout = d
+		}
+	}
+	var (
+		base    = context.WithoutCancel(ctx)
+		shared  context.Context
+		cancelF context.CancelFunc
+	)
+	if timeout > 0 {
+		shared, cancelF = context.WithTimeout(base, timeout)
+	} else {
+		// The resolver which is not created by `New` has no lookup timeout.
+		shared, cancelF = context.WithCancel(base)
+	}
+	if r.ctx == nil {
+		return shared, cancelF
+	}
+	stop := context.AfterFunc(r.ctx, cancelF)
+	return shared, func() {
+		stop()
+		cancelF()
+	}
+}
+
+// rootContext returns the context of the resolver which is canceled by `Stop`. The
+// resolver which is not created by `New` has none and it returns `context.Background()`.
+func (r *Resolver) rootContext() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// lookup lookups IP list from DNS server and saves result in the cache.
+func (r *Resolver) lookup(ctx context.Context, addr string) ([]net.IP, error) {
+	r.log().DebugContext(ctx, "looking up DNS",
+		"addr", addr,
+	)
+	start := r.now()
+	ips, zones, ttl, err := r.lookupWithRetry(ctx, addr)
+	r.log().DebugContext(ctx, "looked up DNS",
+		"addr", addr,
+		"ips", len(ips),
+		"duration", r.now().Sub(start),
+		"error", err,
+	)
 	if err != nil {
+		err = &LookupError{Host: addr, Err: err}
+		if r.negativeTTL > 0 && isNotFound(err) {
+			r.lock.Lock()
+			if r.negCache == nil {
+				r.negCache = make(map[string]negativeEntry)
+			}
+			r.negCache[addr] = negativeEntry{err: err, expireAt: r.now().Add(r.negativeTTL)}
+			r.lock.Unlock()
+		}
+		r.onLookupError(addr, err)
 		return nil, err
 	}
 
+	ips = r.filterIPs(r.family.filter(dedupeIPs(ips)))
+	if len(ips) == 0 {
+		err := &LookupError{Host: addr, Err: &net.AddrError{Err: "no suitable address found", Addr: addr}}
+		r.onLookupError(addr, err)
+		return nil, err
+	}
+
+	if r.maxIPs > 0 && len(ips) > r.maxIPs {
+		var prev []net.IP
+		if old, ok := r.getEntry(addr); ok {
+			prev = old.ips
+		}
+		ips = r.sampleIPs(ips, prev, r.maxIPs)
+	}
+	if r.stableSort {
+		sortIPs(ips)
+	}
+
+	var canonicalName string
+	if r.captureCNAME {
+		// The canonical name is optional, so the failure does not fail the lookup.
+		var cname string
+		done, err := r.startQuery(ctx)
+		if err == nil {
+			cname, err = r.lookupCNAMEFn(ctx, addr)
+			done()
+		}
+		if err == nil {
+			canonicalName = NormalizeHost(cname)
+		} else {
+			r.log().Debug("failed to lookup canonical name",
+				"error", err,
+				"addr", addr,
+			)
+		}
+	}
+
+	now := r.now()
+	entry := &Entry{ips: ips, refreshedAt: now, canonicalName: canonicalName, zones: zones}
+	if ttl = r.clampTTL(ttl); ttl > 0 {
+		entry.expireAt = now.Add(ttl)
+	}
+
 	r.lock.Lock()
-	r.cache[addr] = ips
+	// Keep the cached IP list if the IP set is unchanged.
+	old, ok := r.cache.Get(addr)
+	changed := ok && !sameIPs(old.ips, ips)
+	if ok && !changed {
+		entry.ips = old.ips
+	}
+	r.cache.Set(addr, entry)
+	delete(r.negCache, addr)
+	r.resetFailures(addr)
+	var evicted []string
+	if !ok {
+		evicted = r.admit(addr)
+	}
+	var changes int
+	if changed {
+		changes = r.recordChurn(addr)
+	}
 	r.lock.Unlock()
+	r.logEvicted(evicted)
+	r.scheduleEntry(addr, entry)
+
+	if changed && r.onIPsChangedFn != nil {
+		added, removed := diffIPs(old.ips, ips)
+		r.onIPsChangedFn(addr, added, removed)
+	}
+	if changes >= r.churnThreshold && r.onChurnFn != nil {
+		r.onChurnFn(addr, changes)
+	}
 	return ips, nil
 }
 
+// onLookupError calls the function set by `WithOnLookupError` option if any.
+// The caller must not hold the lock.
+func (r *Resolver) onLookupError(addr string, err error) {
+	if r.onLookupErrorFn != nil {
+		r.onLookupErrorFn(addr, err)
+	}
+}
+
+// clampTTL clamps the given TTL by the bounds set by `WithRefreshBounds` option.
+// The unknown TTL (0) is treated as shorter than any min bound.
+func (r *Resolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < r.minRefresh {
+		ttl = r.minRefresh
+	}
+	if r.maxRefresh > 0 && ttl > r.maxRefresh {
+		ttl = r.maxRefresh
+	}
+	return ttl
+}
+
+// lookupWithRetry calls the lookup function. If `WithLookupRetries` option is set,
+// it retries the lookup failed by a timeout or temporary error with exponential backoff
+// by the clock of the resolver until the context is done. It also returns the zones of
+// the IPs keyed by ipKey.
+func (r *Resolver) lookupWithRetry(ctx context.Context, addr string) ([]net.IP, map[string]string, time.Duration, error) {
+	backoff := r.retryBackoff
+	for i := 0; ; i++ {
+		done, err := r.startQuery(ctx)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		start := r.now()
+		addrs, ttl, err := r.lookupFunc(ctx)(ctx, addr)
+		done()
+		r.counters.observeLookup(r.now().Sub(start), err)
+		if err == nil || i >= r.retries || !isRetryable(err) {
+			ips, zones := splitZones(addrs)
+			return ips, zones, ttl, err
+		}
+
+		// The ticker of the clock is used as a timer, which is stopped after the first tick.
+		timer := r.clockOrDefault().NewTicker(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, 0, err
+		case <-timer.C():
+		}
+		timer.Stop()
+		// The select picks randomly if the context is done at the same time.
+		if ctx.Err() != nil {
+			return nil, nil, 0, err
+		}
+		backoff *= 2
+	}
+}
+
 // Fetch fetches IP list from the cache. If IP list of the given addr is not in the cache,
-// then it lookups from DNS server by `Lookup` function.
+// then it lookups from DNS server by `Lookup` function. The returned IP list is a copy
+// of the cache, so it is safe to modify it.
+//
+// If `WithNegativeTTL` option is set and the last lookup of the addr failed because
+// the host was not found, it returns the cached error until the negative TTL elapses.
 func (r *Resolver) Fetch(ctx context.Context, addr string) ([]net.IP, error) {
+	ips, _, err := r.FetchWithMeta(ctx, addr)
+	return ips, err
+}
+
+// FetchMeta describes how `FetchWithMeta` fetched the IP list.
+type FetchMeta struct {
+	// Hit is true if the IP list (or the cached error) is served from the cache
+	// without lookup.
+	Hit bool
+
+	// LastRefreshed is when the IP list was looked up last. It is zero for
+	// static entries and IP literals.
+	LastRefreshed time.Time
+
+	// CanonicalName is the canonical name of the host (without the trailing dot),
+	// i.e. the final target of the CNAME chain. It is set only when `WithCanonicalName`
+	// option is set.
+	CanonicalName string
+}
+
+// FetchWithMeta is like `Fetch` but also returns whether it is served from the cache.
+func (r *Resolver) FetchWithMeta(ctx context.Context, addr string) ([]net.IP, FetchMeta, error) {
+	ips, shared, meta, err := r.fetch(ctx, addr)
+	if shared {
+		ips = copyIPs(ips)
+	}
+	return ips, meta, err
+}
+
+// FetchInto is like `Fetch` but appends the IP list to dst and returns the extended
+// slice, so that a caller reusing dst does not allocate on a cache hit.
+//
+// Unlike `Fetch`, the appended IPs are not copied: they share the underlying bytes with
+// the cache, which are never modified. The caller must not modify the bytes of the
+// appended IPs, though it can freely reorder, truncate and reuse dst itself.
+func (r *Resolver) FetchInto(ctx context.Context, addr string, dst []net.IP) ([]net.IP, error) {
+	ips, _, _, err := r.fetch(ctx, addr)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, ips...), nil
+}
+
+// fetch fetches IP list like `FetchWithMeta`. It reports whether the returned IP list
+// shares the underlying bytes with the cache, in which case it must not be modified.
+func (r *Resolver) fetch(ctx context.Context, addr string) ([]net.IP, bool, FetchMeta, error) {
+	if err := validateHost(addr); err != nil {
+		return nil, false, FetchMeta{}, err
+	}
+	addr = NormalizeHost(addr)
+	if ip := parseIPLiteral(addr); ip != nil {
+		return []net.IP{ip}, false, FetchMeta{Hit: true}, nil
+	}
+	if r.bypassCache(ctx, addr) {
+		ips, err := r.lookupUncached(ctx, addr)
+		if err != nil {
+			return nil, false, FetchMeta{}, err
+		}
+		return r.healthyIPs(ips), false, FetchMeta{}, nil
+	}
+
+	r.touch(addr)
+	// Check the level first not to allocate the attributes on the hot path.
+	debug := r.log().Enabled(ctx, slog.LevelDebug)
+	if entry, ok := r.getEntry(addr); ok && !entry.invalidated {
+		r.counters.cacheHits.Add(1)
+		if debug {
+			r.log().DebugContext(ctx, "DNS cache hit",
+				"addr", addr,
+			)
+		}
+		if r.backgroundRefresh && r.stale(entry, r.now()) {
+			r.refreshInBackground(addr)
+		}
+		return r.healthyIPs(entry.ips), true, entry.meta(true), nil
+	}
 	r.lock.RLock()
-	ips, ok := r.cache[addr]
+	neg, negOK := r.negCache[addr]
 	r.lock.RUnlock()
-	if ok {
-		return ips, nil
+	if negOK && r.now().Before(neg.expireAt) {
+		r.counters.cacheHits.Add(1)
+		if debug {
+			r.log().DebugContext(ctx, "DNS cache hit",
+				"addr", addr,
+				"negative", true,
+			)
+		}
+		return nil, false, FetchMeta{Hit: true}, neg.err
 	}
-	return r.LookupIP(ctx, addr)
+	r.counters.cacheMisses.Add(1)
+	if debug {
+		r.log().DebugContext(ctx, "DNS cache miss",
+			"addr", addr,
+		)
+	}
+
+	ips, err := r.LookupIP(ctx, addr)
+	if err != nil {
+		return nil, false, FetchMeta{}, err
+	}
+
+	var meta FetchMeta
+	if entry, ok := r.getEntry(addr); ok {
+		meta = entry.meta(false)
+	}
+	return r.healthyIPs(ips), false, meta, nil
 }
 
-// Refresh refreshes IP list cache.
-func (r *Resolver) Refresh() {
+// Peek returns the cached IP list of the given addr without DNS lookup. It reports
+// whether the IP list is in the cache, i.e. whether `Fetch` would serve it without lookup.
+// Unlike `Fetch`, it does not count toward the statistics nor mark the addr as recently
+// used. The returned IP list is a copy of the cache, so it is safe to modify it.
+func (r *Resolver) Peek(addr string) ([]net.IP, bool) {
+	addr = NormalizeHost(addr)
+	if ip := parseIPLiteral(addr); ip != nil {
+		return []net.IP{ip}, true
+	}
+
+	entry, ok := r.getEntry(addr)
+	if !ok || entry.invalidated {
+		return nil, false
+	}
+	return copyIPs(entry.ips), true
+}
+
+// neverRefreshed is the TTL returned by `FetchWithTTL` for the IP lists which are never
+// refreshed.
+const neverRefreshed = time.Duration(math.MaxInt64)
+
+// FetchWithTTL fetches IP list like `Fetch` and also returns the remaining time until the
+// entry is due for refresh, e.g. for the caller to schedule its own revalidation. It is
+// zero or negative if the entry is already due. For the static entries and IP literals,
+// which are never refreshed, it is the maximum duration. For the IP lists which are not
+// cached, e.g. by `WithHostAllowlist` option, it is zero.
+func (r *Resolver) FetchWithTTL(ctx context.Context, addr string) ([]net.IP, time.Duration, error) {
+	ips, err := r.Fetch(ctx, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addr = NormalizeHost(addr)
+	if parseIPLiteral(addr) != nil {
+		return ips, neverRefreshed, nil
+	}
+	if r.bypassCache(ctx, addr) {
+		return ips, 0, nil
+	}
+	entry, ok := r.getEntry(addr)
+	if !ok {
+		return ips, 0, nil
+	}
+	if entry.static {
+		return ips, neverRefreshed, nil
+	}
+	return ips, r.refreshAt(entry).Sub(r.now()), nil
+}
+
+// stale reports whether the given entry should be refreshed in background by `Fetch`.
+// The entry whose TTL is unknown is stale after the refresh frequency.
+func (r *Resolver) stale(entry *Entry, now time.Time) bool {
+	if entry.static {
+		return false
+	}
+	if entry.expireAt.IsZero() {
+		return now.Sub(entry.refreshedAt) >= r.freq
+	}
+	return entry.expired(now)
+}
+
+// refreshInBackground refreshes the given addr in a new goroutine unless it is already
+// being refreshed in background. The refresh is canceled by `Stop`.
+func (r *Resolver) refreshInBackground(addr string) {
+	if _, loaded := r.bgRefreshing.LoadOrStore(addr, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		defer r.bgRefreshing.Delete(addr)
+		_ = r.refreshAddr(r.rootContext(), addr)
+	}()
+}
+
+// FetchMany fetches IP lists of the given hosts like `Fetch`. The hosts which are not
+// in the cache are looked up concurrently. The returned map is keyed by the given hosts
+// and contains only the hosts fetched successfully. The errors of the other hosts are
+// joined and returned.
+func (r *Resolver) FetchMany(ctx context.Context, hosts []string) (map[string][]net.IP, error) {
+	var (
+		mu     sync.Mutex
+		result = make(map[string][]net.IP, len(hosts))
+		errs   []error
+	)
+	fetch := func(host string) {
+		ips, err := r.Fetch(ctx, host)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		result[host] = ips
+	}
+
+	// Serve the cached hosts first not to wait for the lookups of the others.
+	var misses []string
+	for _, host := range hosts {
+		if r.cached(host) {
+			fetch(host)
+			continue
+		}
+		misses = append(misses, host)
+	}
+	forEachConcurrently(misses, fetchManyConcurrency, fetch)
+	return result, errors.Join(errs...)
+}
+
+// cached reports whether `Fetch` of the given addr is served without lookup.
+func (r *Resolver) cached(addr string) bool {
+	addr = NormalizeHost(addr)
+	if parseIPLiteral(addr) != nil {
+		return true
+	}
+
+	if entry, ok := r.getEntry(addr); ok && !entry.invalidated {
+		return true
+	}
 	r.lock.RLock()
-	addrs := make([]string, 0, len(r.cache))
-	for addr := range r.cache {
-		addrs = append(addrs, addr)
+	defer r.lock.RUnlock()
+	neg, ok := r.negCache[addr]
+	return ok && r.now().Before(neg.expireAt)
+}
+
+// Refresh refreshes IP list cache. It only refreshes the entries whose TTL
+// has elapsed unless `WithFixedFrequency` option is set. Errors are logged.
+func (r *Resolver) Refresh() {
+	_ = r.RefreshContext(context.Background())
+}
+
+// RefreshContext refreshes IP list cache like `Refresh`. The whole refresh is
+// cancelled by the given context: it stops waiting for the lookups in progress and
+// the rest of the hosts are not looked up. The lookups in progress are shared with
+// the other callers, so they keep running until the lookup timeout elapses or `Stop`
+// is called, and their results are still cached. It returns the joined errors of the
+// hosts which failed to be refreshed, and the context error if it is cancelled.
+func (r *Resolver) RefreshContext(ctx context.Context) error {
+	return r.refresh(ctx, true)
+}
+
+// refresh refreshes the cache like `RefreshContext`. The IP lists are not refreshed unless
+// entries is true, i.e. only the negative cache, the idle hosts and SRV records are handled.
+func (r *Resolver) refresh(ctx context.Context, entries bool) error {
+	now := r.now()
+	r.lock.Lock()
+	for addr, neg := range r.negCache {
+		if !now.Before(neg.expireAt) {
+			delete(r.negCache, addr)
+		}
 	}
+	// Every refresh starts a new window of the churn.
+	clear(r.churn)
+	r.lock.Unlock()
+	r.evictIdle(now)
+
+	r.lock.RLock()
+	var addrs []string
+	r.forEachEntry(func(addr string, entry *Entry) {
+		if entry.static || !entries {
+			return
+		}
+		if r.fixedFreq || entry.invalidated || entry.expired(now) {
+			addrs = append(addrs, addr)
+		}
+	})
 	r.lock.RUnlock()
 
+	concurrency := r.refreshConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	forEachConcurrently(addrs, concurrency, func(addr string) {
+		// Do not start the lookups of the rest once the refresh is cancelled.
+		if ctx.Err() != nil {
+			return
+		}
+		if err := r.refreshAddr(ctx, addr); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	})
+	r.log().DebugContext(ctx, "refreshed DNS cache",
+		"hosts", len(addrs),
+		"failures", len(errs),
+	)
+	if err := ctx.Err(); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	errs = append(errs, r.refreshSRV(ctx)...)
+
+	return errors.Join(errs...)
+}
+
+// forEachConcurrently calls fn for each addr with at most n goroutines at the same time.
+// It returns when all calls finish.
+func forEachConcurrently(addrs []string, n int, fn func(addr string)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
 	for _, addr := range addrs {
-		ctx, cancelF := context.WithTimeout(context.Background(), r.defaultLookupTimeout)
-		if _, err := r.LookupIP(ctx, addr); err != nil {
-			r.logger.Error("failed to refresh DNS cache",
-				"error", err,
-				"addr", addr,
-			)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(addr)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// refreshAddr refreshes IP list cache of the given addr with the refresh lookup timeout.
+func (r *Resolver) refreshAddr(ctx context.Context, addr string) error {
+	lookupCtx, cancelF := context.WithTimeout(ctx, r.lookupTimeout(addr, r.refreshLookupTimeout))
+	defer cancelF()
+
+	if _, err := r.LookupIP(lookupCtx, addr); err != nil {
+		// The cancelled refresh is not the failure of the host.
+		if ctx.Err() != nil {
+			return err
 		}
-		cancelF()
+		r.counters.refreshFailures.Add(1)
+		r.log().Error("failed to refresh DNS cache",
+			"error", err,
+			"addr", addr,
+		)
+		if !r.recordFailure(addr, err) {
+			r.handleStale(addr)
+		}
+		return err
 	}
+	r.counters.refreshSuccesses.Add(1)
+	return nil
 }
 
-// Stop stops auto refreshing.
-func (r *Resolver) Stop() {
+// lookupTimeout returns the lookup timeout of the given host set by `WithHostTimeout`
+// option. If it is not set, it returns fallback.
+func (r *Resolver) lookupTimeout(host string, fallback time.Duration) time.Duration {
+	if d, ok := r.hostTimeouts[NormalizeHost(host)]; ok {
+		return d
+	}
+	return fallback
+}
+
+// RefreshHost refreshes IP list cache of the given addr. The lookup is cancelled by
+// the given context. If the lookup fails, it returns the error and the cached IP list
+// is kept as it is.
+func (r *Resolver) RefreshHost(ctx context.Context, addr string) error {
+	if _, err := r.LookupIP(ctx, addr); err != nil {
+		r.counters.refreshFailures.Add(1)
+		return err
+	}
+	r.counters.refreshSuccesses.Add(1)
+	return nil
+}
+
+// recordFailure counts the refresh failure of the given addr for `HostStats`. The failures
+// caused by the errors which match the predicate set by `WithEvictOnErrors` option
+// (not-found errors by default) also count toward removing the host, and it is removed
+// from the cache when the count reaches the threshold set by `WithRemoveFailedHosts`
+// option. It reports whether the entry is removed.
+func (r *Resolver) recordFailure(addr string, err error) bool {
+	threshold := r.removeThreshold
+	if threshold <= 0 && r.evictOnErr != nil {
+		threshold = 1
+	}
+	evictOnErr := r.evictOnErr
+	if evictOnErr == nil {
+		evictOnErr = isNotFound
+	}
+
+	r.lock.Lock()
+	entry, ok := r.cache.Get(addr)
+	if !ok || entry.static {
+		r.lock.Unlock()
+		return false
+	}
+	if r.failures == nil {
+		r.failures = make(map[string]hostFailures)
+	}
+	f := r.failures[addr]
+	f.consecutive++
+	f.total++
+	f.lastErr = err
+	if threshold > 0 && evictOnErr(err) {
+		f.evictable++
+	}
+	r.failures[addr] = f
+	evicted := threshold > 0 && f.evictable >= threshold
+	if evicted {
+		r.deleteEntry(addr)
+	}
+	r.lock.Unlock()
+
+	if evicted {
+		r.log().Warn("removed failed host from DNS cache",
+			"addr", addr,
+			"failures", f.evictable,
+		)
+	}
+	return evicted
+}
+
+// handleStale is called when refreshing the given addr failed. If `WithStaleWhileRevalidate`
+// option is set, it drops the entry which has not been refreshed successfully for longer
+// than the max stale duration, otherwise it keeps serving the stale entry.
+func (r *Resolver) handleStale(addr string) {
+	if r.maxStale <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	entry, ok := r.cache.Get(addr)
+	if !ok || entry.static {
+		r.lock.Unlock()
+		return
+	}
+	stale := r.now().Sub(entry.refreshedAt)
+	dropped := stale > r.maxStale
+	if dropped {
+		r.deleteEntry(addr)
+	}
+	r.lock.Unlock()
+
+	if dropped {
+		r.log().Warn("dropped stale DNS cache",
+			"addr", addr,
+			"stale", stale,
+		)
+		if r.onStaleEvictFn != nil {
+			r.onStaleEvictFn(addr)
+		}
+		return
+	}
+	r.log().Warn("serving stale DNS cache",
+		"addr", addr,
+		"stale", stale,
+	)
+}
+
+// Remove removes the given addr from the cache. It does nothing if the addr is
+// not in the cache or is a static entry.
+func (r *Resolver) Remove(addr string) {
+	addr = NormalizeHost(addr)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry, ok := r.cache.Get(addr); ok && !entry.static {
+		r.deleteEntry(addr)
+	}
+	delete(r.negCache, addr)
+	delete(r.failures, addr)
+}
+
+// Invalidate marks the cache of the given addr as invalid so that the next `Fetch`
+// lookups DNS instead of returning the cached IP list. It does nothing if the addr
+// is not in the cache or is a static entry.
+func (r *Resolver) Invalidate(addr string) {
+	addr = NormalizeHost(addr)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.cache.Get(addr)
+	if !ok || entry.static {
+		return
+	}
+	invalidated := *entry
+	invalidated.invalidated = true
+	r.cache.Set(addr, &invalidated)
+	r.scheduleEntry(addr, &invalidated)
+}
+
+// Clear removes all entries except the static entries from the cache.
+// The cached SRV records are also removed.
+func (r *Resolver) Clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.forEachEntry(func(addr string, entry *Entry) {
+		if !entry.static {
+			r.deleteEntry(addr)
+		}
+	})
+	r.srvCache = nil
+	r.negCache = nil
+	r.failures = nil
+	r.churn = nil
+
+	r.dialLock.Lock()
+	r.rrCursors = nil
+	r.lastDialed = nil
+	r.dialLock.Unlock()
+}
+
+// Compact rebuilds the maps of the cache sized to the current entries. Go maps never
+// shrink, so call it to reclaim the memory after many entries are removed, e.g. by
+// eviction after a burst of one-off lookups. The entries are kept as they are. It does
+// nothing with the store set by `WithStore` option.
+func (r *Resolver) Compact() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	if r.closer != nil {
-		r.closer()
-		r.closer = nil
+	if s, ok := r.cache.(shardedStore); ok {
+		s.compact()
+	}
+	if r.negCache != nil {
+		r.negCache = compactMap(r.negCache)
+	}
+	if r.failures != nil {
+		r.failures = compactMap(r.failures)
+	}
+
+	r.dialLock.Lock()
+	if r.rrCursors != nil {
+		r.rrCursors = compactMap(r.rrCursors)
+	}
+	if r.lastDialed != nil {
+		r.lastDialed = compactMap(r.lastDialed)
+	}
+	r.dialLock.Unlock()
+}
+
+// Len returns the number of hosts in the cache.
+func (r *Resolver) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cache.Len()
+}
+
+// Entries returns a copy of all cached hosts and their IP lists.
+func (r *Resolver) Entries() map[string][]net.IP {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	entries := make(map[string][]net.IP)
+	r.forEachEntry(func(addr string, entry *Entry) {
+		entries[addr] = copyIPs(entry.ips)
+	})
+	return entries
+}
+
+// Dump returns the cached hosts, their IP lists and when they were looked up last in one
+// line sorted by host, e.g. for debugging. The static entries are marked as static.
+// The format is for humans and may change.
+func (r *Resolver) Dump() string {
+	type dumped struct {
+		addr  string
+		entry *Entry
+	}
+	r.lock.RLock()
+	var entries []dumped
+	r.forEachEntry(func(addr string, entry *Entry) {
+		entries = append(entries, dumped{addr, entry})
+	})
+	r.lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].addr < entries[j].addr
+	})
+
+	var (
+		b   strings.Builder
+		buf []byte
+	)
+	for i, d := range entries {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(d.addr)
+		b.WriteString("=[")
+		for j, ip := range d.entry.ips {
+			if j > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(ip.String())
+		}
+		b.WriteString("]")
+		switch {
+		case d.entry.static:
+			b.WriteString("(static)")
+		case !d.entry.refreshedAt.IsZero():
+			b.WriteString("(refreshed ")
+			buf = d.entry.refreshedAt.AppendFormat(buf[:0], time.RFC3339)
+			b.Write(buf)
+			b.WriteString(")")
+		}
+	}
+	return b.String()
+}
+
+// NormalizeHost normalizes the given host in the same way as the cache keys, e.g. to
+// match the hosts passed to the hooks such as `WithOnIPsChanged` option.
+// It strips the port, lowercases ASCII letters and strips a trailing dot. The internationalized
+// domain name is converted to the ASCII (punycode) form. If it is malformed,
+// the non-ASCII characters are kept as they are.
+func NormalizeHost(host string) string {
+	host = strings.TrimSuffix(stripPort(host), ".")
+	if ascii, err := toASCII(host); err == nil {
+		host = ascii
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; 'A' <= c && c <= 'Z' {
+			return strings.Map(func(r rune) rune {
+				if 'A' <= r && r <= 'Z' {
+					return r + ('a' - 'A')
+				}
+				return r
+			}, host)
+		}
+	}
+	return host
+}
+
+// toASCII converts the given internationalized domain name to the ASCII form
+// by IDNA2008 lookup rules. It returns the ASCII host as it is.
+func toASCII(host string) (string, error) {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			return idna.Lookup.ToASCII(host)
+		}
+	}
+	return host, nil
+}
+
+// stripPort returns the host of the given host:port, e.g. "example.com" of "example.com:443"
+// and "::1" of "[::1]:443", since the address to dial is often passed by mistake. The other
+// addresses, including IPv6 addresses without brackets, are returned as they are.
+func stripPort(addr string) string {
+	// Check the colon first since `net.SplitHostPort` allocates the error of no port.
+	if strings.IndexByte(addr, ':') < 0 {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// validateHost returns the error if the given addr is a malformed internationalized
+// domain name, which can not be looked up.
+func validateHost(addr string) error {
+	if _, err := toASCII(strings.TrimSuffix(stripPort(addr), ".")); err != nil {
+		return &LookupError{Host: addr, Err: err}
+	}
+	return nil
+}
+
+// parseIPLiteral returns the IP if the given addr is an IPv4 or IPv6 address
+// (optionally enclosed in square brackets). Otherwise it returns nil.
+func parseIPLiteral(addr string) net.IP {
+	if len(addr) > 1 && addr[0] == '[' && addr[len(addr)-1] == ']' {
+		addr = addr[1 : len(addr)-1]
+	}
+	// Host names have no colon, and IPv4 addresses have only digits and dots. Skip
+	// parsing the other host names since `net.ParseIP` allocates on failure.
+	if strings.IndexByte(addr, ':') < 0 && strings.Trim(addr, "0123456789.") != "" {
+		return nil
+	}
+	return net.ParseIP(addr)
+}
+
+// sameIPs reports whether the given IP lists contain the same IPs regardless of the order.
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, ip := range a {
+		counts[ipKey(ip)]++
+	}
+	for _, ip := range b {
+		key := ipKey(ip)
+		if counts[key] == 0 {
+			return false
+		}
+		counts[key]--
+	}
+	return true
+}
+
+// diffIPs returns the IPs which are in next but not in prev and the IPs which are in
+// prev but not in next.
+func diffIPs(prev, next []net.IP) (added, removed []net.IP) {
+	prevKeys := make(map[string]struct{}, len(prev))
+	for _, ip := range prev {
+		prevKeys[ipKey(ip)] = struct{}{}
+	}
+	nextKeys := make(map[string]struct{}, len(next))
+	for _, ip := range next {
+		nextKeys[ipKey(ip)] = struct{}{}
+		if _, ok := prevKeys[ipKey(ip)]; !ok {
+			added = append(added, append(net.IP(nil), ip...))
+		}
+	}
+	for _, ip := range prev {
+		if _, ok := nextKeys[ipKey(ip)]; !ok {
+			removed = append(removed, append(net.IP(nil), ip...))
+		}
+	}
+	return added, removed
+}
+
+// ipKey returns the map key of the given IP so that IPv4 addresses in the 4-byte
+// and 16-byte forms are the same key.
+func ipKey(ip net.IP) string {
+	if ip16 := ip.To16(); ip16 != nil {
+		return string(ip16)
+	}
+	return string(ip)
+}
+
+// copyIPs returns a deep copy of the given IP list so that callers
+// can not modify the cached one.
+func copyIPs(ips []net.IP) []net.IP {
+	copied := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		copied[i] = append(net.IP(nil), ip...)
+	}
+	return copied
+}
+
+// Stop stops auto refreshing. The refresh in progress is aborted. It is safe to call it
+// multiple times concurrently. Use `Done` to wait until refreshing has stopped.
+func (r *Resolver) Stop() {
+	if r.stop == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		if r.cancel != nil {
+			r.cancel()
+		}
+	})
+}
+
+// SetLogger replaces the logger of the resolver, e.g. to raise the verbosity of the running
+// resolver temporarily. It is safe to call it concurrently with the other methods. Nil
+// means `slog.Default()`.
+func (r *Resolver) SetLogger(logger *slog.Logger) {
+	r.logger.Store(logger)
+}
+
+// log returns the current logger.
+func (r *Resolver) log() *slog.Logger {
+	if logger := r.logger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Pause pauses auto refreshing until `Resume` is called, e.g. to hold the cached IP lists
+// during maintenance. The cache is kept and `Fetch` works as usual, looking up the hosts
+// which are not cached. It does nothing if it is already paused.
+func (r *Resolver) Pause() {
+	r.paused.Store(true)
+}
+
+// Resume resumes auto refreshing paused by `Pause`. The entries are refreshed on the next
+// tick. It does nothing if it is not paused.
+func (r *Resolver) Resume() {
+	r.paused.Store(false)
+	if r.sched != nil {
+		// Wake the scheduler to refresh the hosts which got due while paused.
+		select {
+		case r.sched.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Done returns a channel which is closed when auto refreshing has stopped
+// by `Stop` or cancellation of the context given to `NewWithContext`.
+func (r *Resolver) Done() <-chan struct{} {
+	return r.done
+}
+
+// IsRunning reports whether auto refreshing is running.
+func (r *Resolver) IsRunning() bool {
+	if r.done == nil {
+		return false
+	}
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
 	}
 }
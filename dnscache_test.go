@@ -3,10 +3,14 @@ package dnscache
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -27,6 +31,12 @@ func testResolver(t *testing.T) *Resolver {
 	return r
 }
 
+// getEntry returns the cache entry of the given host, or nil if it is not cached.
+func getEntry(r *Resolver, host string) *Entry {
+	entry, _ := r.cache.Get(host)
+	return entry
+}
+
 func TestNew(t *testing.T) {
 	{
 		resolver, err := New(testFreq, testDefaultLookupTimeout)
@@ -88,8 +98,8 @@ func TestLookupCache(t *testing.T) {
 	want := []net.IP{
 		net.IP("35.190.50.136"),
 	}
-	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
-		return want, nil
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return ipAddrsOf(want), 0, nil
 	}
 
 	ctx := context.Background()
@@ -105,12 +115,12 @@ func TestLookupCache(t *testing.T) {
 		t.Fatalf("want %#v, got %#v", want, got)
 	}
 
-	got2, ok := resolver.cache["gateway.io"]
+	entry, ok := resolver.cache.Get("gateway.io")
 	if !ok {
 		t.Fatalf("expect cache to be created")
 	}
 
-	if !reflect.DeepEqual(want, got2) {
+	if got2 := entry.ips; !reflect.DeepEqual(want, got2) {
 		t.Fatalf("want %#v, got %#v", want, got2)
 	}
 }
@@ -123,11 +133,11 @@ func TestLookupTimeout(t *testing.T) {
 
 	ctx, cancelF := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancelF()
-	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
 		for {
 			select {
 			case <-ctx.Done():
-				return nil, ctx.Err()
+				return nil, 0, ctx.Err()
 			default:
 			}
 			time.Sleep(200 * time.Millisecond)
@@ -143,6 +153,66 @@ func TestLookupTimeout(t *testing.T) {
 	}
 }
 
+func TestLookupSharedContext(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var once sync.Once
+	started := make(chan struct{})
+	release := make(chan struct{})
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		once.Do(func() { close(started) })
+		select {
+		case <-release:
+			return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	var onErr atomic.Int32
+	resolver, err := New(time.Hour, time.Hour, WithOnLookupError(func(host string, err error) {
+		onErr.Add(1)
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	// The first caller gives up the shared lookup.
+	ctx, cancelF := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancelF()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := resolver.Fetch(ctx, "a.jp")
+		errCh <- err
+	}()
+	<-started
+
+	ipsCh := make(chan []net.IP, 1)
+	go func() {
+		ips, err := resolver.Fetch(context.Background(), "a.jp")
+		if err != nil {
+			t.Errorf("err: %s", err)
+		}
+		ipsCh <- ips
+	}()
+
+	if err := <-errCh; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect timeout error, got %v", err)
+	}
+	close(release)
+
+	if want, got := []net.IP{net.IP("10.0.0.1")}, <-ipsCh; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if n := onErr.Load(); n != 0 {
+		t.Fatalf("expect no lookup error, got %d", n)
+	}
+}
+
 func TestRefresh(t *testing.T) {
 	originalFunc := lookupIP
 	defer func() {
@@ -152,35 +222,103 @@ func TestRefresh(t *testing.T) {
 	want := []net.IP{
 		net.IP("4.4.4.4"),
 	}
-	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
-		return want, nil
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return ipAddrsOf(want), 0, nil
 	}
 
 	resolver := testResolver(t)
 	defer resolver.Stop()
-	resolver.cache = map[string][]net.IP{
-		"deeeet.jp": {
+	resolver.cache = mapStore{
+		"deeeet.jp": {ips: []net.IP{
 			net.IP("1.1.1.1"),
-		},
-		"deeeet.us": {
+		}},
+		"deeeet.us": {ips: []net.IP{
 			net.IP("2.2.2.2"),
-		},
-		"deeeet.uk": {
+		}},
+		"deeeet.uk": {ips: []net.IP{
 			net.IP("3.3.3.3"),
-		},
+		}},
 	}
 
 	// Refresh all IP to same one
 	resolver.Refresh()
 
 	// Ensure all cache are refreshed
-	for _, got := range resolver.cache {
-		if !reflect.DeepEqual(want, got) {
+	for _, entry := range resolver.cache.(mapStore) {
+		if got := entry.ips; !reflect.DeepEqual(want, got) {
 			t.Fatalf("want %#v, got %#v", want, got)
 		}
 	}
 }
 
+func TestRefreshTTL(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var mu sync.Mutex
+	var looked []string
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		looked = append(looked, host)
+		mu.Unlock()
+		return []net.IPAddr{{IP: net.IP("4.4.4.4")}}, time.Minute, nil
+	}
+
+	cases := []struct {
+		name    string
+		options []Option
+		want    []string
+	}{
+		{
+			name: "TTL",
+			want: []string{"expired.jp", "unknown.jp"},
+		},
+		{
+			name:    "FixedFrequency",
+			options: []Option{WithFixedFrequency()},
+			want:    []string{"alive.jp", "expired.jp", "unknown.jp"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver, err := New(time.Hour, testDefaultLookupTimeout, tc.options...)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer resolver.Stop()
+
+			now := time.Now()
+			resolver.cache = mapStore{
+				"alive.jp":   {ips: []net.IP{net.IP("1.1.1.1")}, expireAt: now.Add(time.Hour)},
+				"expired.jp": {ips: []net.IP{net.IP("2.2.2.2")}, expireAt: now.Add(-time.Second)},
+				"unknown.jp": {ips: []net.IP{net.IP("3.3.3.3")}},
+			}
+
+			mu.Lock()
+			looked = nil
+			mu.Unlock()
+
+			resolver.Refresh()
+
+			mu.Lock()
+			got := looked
+			mu.Unlock()
+			sort.Strings(got)
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+
+			entry := getEntry(resolver, "expired.jp")
+			if remaining := time.Until(entry.expireAt); remaining <= 0 || remaining > time.Minute {
+				t.Fatalf("expect expiry to be updated by TTL, got %v", remaining)
+			}
+		})
+	}
+}
+
 func TestRefreshed(t *testing.T) {
 	originalFunc := onRefreshed
 	defer func() {
@@ -205,6 +343,34 @@ func TestRefreshed(t *testing.T) {
 	}
 }
 
+func TestOnRefreshedOption(t *testing.T) {
+	var counter1, counter2 int32
+	resolver1, err := New(1*time.Millisecond, testDefaultLookupTimeout, WithOnRefreshed(func() {
+		atomic.AddInt32(&counter1, 1)
+	}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resolver1.Stop()
+
+	resolver2, err := New(time.Hour, testDefaultLookupTimeout, WithOnRefreshed(func() {
+		atomic.AddInt32(&counter2, 1)
+	}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resolver2.Stop()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if cnt := atomic.LoadInt32(&counter1); cnt < 5 {
+		t.Fatalf("Not refreshed enough: %d", cnt)
+	}
+	if cnt := atomic.LoadInt32(&counter2); cnt != 0 {
+		t.Fatalf("expect other resolver not to be refreshed: %d", cnt)
+	}
+}
+
 func TestFetch(t *testing.T) {
 	mu := new(sync.Mutex)
 
@@ -214,11 +380,11 @@ func TestFetch(t *testing.T) {
 	}()
 
 	var returnIPs []net.IP
-	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
 		mu.Lock()
 		ips := returnIPs
 		mu.Unlock()
-		return ips, nil
+		return ipAddrsOf(ips), 0, nil
 	}
 
 	ctx := context.Background()
@@ -287,8 +453,8 @@ func TestErrorLog(t *testing.T) {
 		done <- struct{}{}
 	}
 
-	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
-		return nil, fmt.Errorf("err")
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return nil, 0, fmt.Errorf("err")
 	}
 
 	buf := new(bytes.Buffer)
@@ -305,3 +471,2441 @@ func TestErrorLog(t *testing.T) {
 		t.Fatalf("expect logger called more than once")
 	}
 }
+
+func TestStaticEntries(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IP("4.4.4.4")}}, 0, nil
+	}
+
+	want := []net.IP{net.IP("10.0.0.1")}
+	resolver, err := New(testFreq, testDefaultLookupTimeout, WithStaticEntries(map[string][]net.IP{
+		"static.jp": want,
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ctx := context.Background()
+	got, err := resolver.Fetch(ctx, "static.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %#v, got %#v", want, got)
+	}
+
+	got, err = resolver.LookupIP(ctx, "static.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %#v, got %#v", want, got)
+	}
+
+	resolver.Refresh()
+	resolver.lock.RLock()
+	got = getEntry(resolver, "static.jp").ips
+	resolver.lock.RUnlock()
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %#v, got %#v", want, got)
+	}
+
+	if cnt := atomic.LoadInt32(&called); cnt != 0 {
+		t.Fatalf("expect lookup not to be called, called %d times", cnt)
+	}
+
+	// Modifying the given IP list does not change the entry.
+	want[0][0] = '2'
+	got, err = resolver.Fetch(ctx, "static.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IP("10.0.0.1")}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %#v, got %#v", want, got)
+	}
+}
+
+func TestFetchCopy(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	resolved := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return ipAddrsOf(resolved), 0, nil
+	}
+
+	ctx := context.Background()
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(ctx, "copy.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ips, err := resolver.Fetch(ctx, "copy.jp")
+			if err != nil {
+				t.Errorf("err: %s", err)
+				return
+			}
+			for i := range ips {
+				ips[i][len(ips[i])-1] = 0
+			}
+			ips[0] = nil
+		}()
+		go func() {
+			defer wg.Done()
+			resolver.Refresh()
+		}()
+	}
+	wg.Wait()
+
+	got, err := resolver.Fetch(ctx, "copy.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %#v, got %#v", want, got)
+	}
+}
+
+func TestFetchInto(t *testing.T) {
+	resolver := &Resolver{
+		cache: mapStore{
+			"a.jp": {ips: []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}},
+		},
+	}
+
+	dst := []net.IP{net.IPv4(10, 0, 0, 9)}
+	got, err := resolver.FetchInto(context.Background(), "a.jp", dst)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []net.IP{net.IPv4(10, 0, 0, 9), net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	buf := make([]net.IP, 0, 4)
+	if allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = resolver.FetchInto(context.Background(), "a.jp", buf[:0])
+	}); allocs != 0 {
+		t.Fatalf("expect no allocation on cache hit, got %v", allocs)
+	}
+}
+
+func BenchmarkFetch(b *testing.B) {
+	resolver := &Resolver{
+		cache: newShardedStore(cacheShards),
+	}
+	resolver.cache.Set("a.jp", &Entry{ips: []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}})
+	ctx := context.Background()
+
+	b.Run("Fetch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := resolver.Fetch(ctx, "a.jp"); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		}
+	})
+	b.Run("FetchInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []net.IP
+		for i := 0; i < b.N; i++ {
+			var err error
+			if buf, err = resolver.FetchInto(ctx, "a.jp", buf[:0]); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		}
+	})
+}
+
+func TestFetchSingleflight(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		time.Sleep(100 * time.Millisecond)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	ctx := context.Background()
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := resolver.Fetch(ctx, "singleflight.jp"); err != nil {
+				t.Errorf("err: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect lookup to be called once, called %d times", cnt)
+	}
+}
+
+func TestIPFamily(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "v4.jp" {
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, 0, nil
+		}
+		return []net.IPAddr{
+			{IP: net.ParseIP("10.0.0.1")},
+			{IP: net.ParseIP("2001:db8::1")},
+			{IP: net.ParseIP("10.0.0.2")},
+		}, 0, nil
+	}
+
+	cases := []struct {
+		family IPFamily
+		want   []net.IP
+	}{
+		{
+			family: DualStack,
+			want:   []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.2")},
+		},
+		{
+			family: IPv4Only,
+			want:   []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		},
+		{
+			family: IPv6Only,
+			want:   []net.IP{net.ParseIP("2001:db8::1")},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%d", tc.family), func(t *testing.T) {
+			resolver, err := New(time.Hour, testDefaultLookupTimeout, WithIPFamily(tc.family))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer resolver.Stop()
+
+			got, err := resolver.Fetch(context.Background(), "mixed.jp")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+			if cached := getEntry(resolver, "mixed.jp").ips; !reflect.DeepEqual(tc.want, cached) {
+				t.Fatalf("want %v cached, got %v", tc.want, cached)
+			}
+		})
+	}
+
+	t.Run("NoAddress", func(t *testing.T) {
+		resolver, err := New(time.Hour, testDefaultLookupTimeout, WithIPFamily(IPv6Only))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer resolver.Stop()
+
+		if _, err := resolver.Fetch(context.Background(), "v4.jp"); err == nil {
+			t.Fatalf("expect to be failed")
+		}
+		if _, ok := resolver.cache.Get("v4.jp"); ok {
+			t.Fatalf("expect not to be cached")
+		}
+	})
+}
+
+func TestRemove(t *testing.T) {
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	resolver.cache = mapStore{
+		"deeeet.jp":  {ips: []net.IP{net.IP("1.1.1.1")}},
+		"static.jp":  {ips: []net.IP{net.IP("2.2.2.2")}, static: true},
+		"deeeet.com": {ips: []net.IP{net.IP("3.3.3.3")}},
+	}
+
+	resolver.Remove("deeeet.jp")
+	resolver.Remove("static.jp")
+	resolver.Remove("unknown.jp")
+
+	if _, ok := resolver.cache.Get("deeeet.jp"); ok {
+		t.Fatalf("expect entry to be removed")
+	}
+	for _, addr := range []string{"static.jp", "deeeet.com"} {
+		if _, ok := resolver.cache.Get(addr); !ok {
+			t.Fatalf("expect %s not to be removed", addr)
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	ctx := context.Background()
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Fetch(ctx, "invalidate.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect lookup to be called once, called %d times", cnt)
+	}
+
+	resolver.Invalidate("invalidate.jp")
+	resolver.Invalidate("unknown.jp")
+
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Fetch(ctx, "invalidate.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 2 {
+		t.Fatalf("expect lookup to be called again after invalidate, called %d times", cnt)
+	}
+	if _, ok := resolver.cache.Get("unknown.jp"); ok {
+		t.Fatalf("expect unknown host not to be cached")
+	}
+}
+
+func TestClear(t *testing.T) {
+	resolver, err := New(testFreq, testDefaultLookupTimeout, WithStaticEntries(map[string][]net.IP{
+		"static.jp": {net.IP("10.0.0.1")},
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	resolver.lock.Lock()
+	resolver.cache.Set("deeeet.jp", &Entry{ips: []net.IP{net.IP("1.1.1.1")}})
+	resolver.cache.Set("deeeet.us", &Entry{ips: []net.IP{net.IP("2.2.2.2")}})
+	resolver.lock.Unlock()
+
+	if got, want := resolver.Len(), 3; got != want {
+		t.Fatalf("want %d, got %d", want, got)
+	}
+
+	resolver.Clear()
+
+	if got, want := resolver.Len(), 1; got != want {
+		t.Fatalf("want %d, got %d", want, got)
+	}
+	if _, ok := resolver.cache.Get("static.jp"); !ok {
+		t.Fatalf("expect static entry to be kept")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	resolver.cache = mapStore{
+		"deeeet.jp": {ips: []net.IP{net.IPv4(1, 1, 1, 1)}},
+		"deeeet.us": {ips: []net.IP{net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3)}},
+	}
+
+	want := map[string][]net.IP{
+		"deeeet.jp": {net.IPv4(1, 1, 1, 1)},
+		"deeeet.us": {net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3)},
+	}
+	got := resolver.Entries()
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	got["deeeet.jp"][0][15] = 9
+	got["deeeet.us"][1] = net.IPv4(9, 9, 9, 9)
+	delete(got, "deeeet.us")
+	got["deeeet.uk"] = []net.IP{net.IPv4(4, 4, 4, 4)}
+
+	if got := resolver.Entries(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("expect internal cache to be unchanged: want %v, got %v", want, got)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		if host == "timeout.jp" {
+			return nil, 0, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+		}
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ctx := context.Background()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithNegativeTTL(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	// NXDOMAIN is cached.
+	for i := 0; i < 3; i++ {
+		_, err := resolver.Fetch(ctx, "nxdomain.jp")
+		if !isNotFound(err) {
+			t.Fatalf("expect not found error, got %v", err)
+		}
+	}
+	if cnt := atomic.SwapInt32(&called, 0); cnt != 1 {
+		t.Fatalf("expect lookup to be called once, called %d times", cnt)
+	}
+
+	// Looked up again after the negative TTL.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := resolver.Fetch(ctx, "nxdomain.jp"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+	if cnt := atomic.SwapInt32(&called, 0); cnt != 1 {
+		t.Fatalf("expect lookup to be called after TTL, called %d times", cnt)
+	}
+
+	// Timeout is not cached.
+	for i := 0; i < 3; i++ {
+		if _, err := resolver.Fetch(ctx, "timeout.jp"); err == nil {
+			t.Fatalf("expect to be failed")
+		}
+	}
+	if cnt := atomic.SwapInt32(&called, 0); cnt != 3 {
+		t.Fatalf("expect lookup to be called every time, called %d times", cnt)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var fail int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, 0, fmt.Errorf("err")
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, nil))
+
+	ctx := context.Background()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithStaleWhileRevalidate(200*time.Millisecond),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(ctx, "stale.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Stale entry is served while it is within maxStale.
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 3; i++ {
+		resolver.Refresh()
+	}
+	if _, ok := resolver.cache.Get("stale.jp"); !ok {
+		t.Fatalf("expect stale entry to be kept")
+	}
+	if !strings.Contains(buf.String(), "serving stale DNS cache") {
+		t.Fatalf("expect stale log, got %q", buf.String())
+	}
+
+	// Successful refresh resets the stale duration.
+	time.Sleep(150 * time.Millisecond)
+	atomic.StoreInt32(&fail, 0)
+	resolver.Refresh()
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(100 * time.Millisecond)
+	resolver.Refresh()
+	if _, ok := resolver.cache.Get("stale.jp"); !ok {
+		t.Fatalf("expect refreshed entry to be kept")
+	}
+
+	// Stale entry is dropped after maxStale.
+	time.Sleep(150 * time.Millisecond)
+	resolver.Refresh()
+	if _, ok := resolver.cache.Get("stale.jp"); ok {
+		t.Fatalf("expect stale entry to be dropped")
+	}
+}
+
+func TestLookupIPFunc(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		t.Fatalf("expect default lookup not to be called")
+		return nil, 0, nil
+	}
+
+	want1 := []net.IP{net.IP("10.0.0.1")}
+	resolver1, err := New(time.Hour, testDefaultLookupTimeout, WithLookupIPFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+		return want1, nil
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver1.Stop()
+
+	want2 := []net.IP{net.IP("10.0.0.2")}
+	resolver2, err := New(time.Hour, testDefaultLookupTimeout, WithLookupIPFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+		return want2, nil
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver2.Stop()
+
+	ctx := context.Background()
+	got1, err := resolver1.Fetch(ctx, "custom.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(want1, got1) {
+		t.Fatalf("want %#v, got %#v", want1, got1)
+	}
+
+	got2, err := resolver2.Fetch(ctx, "custom.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(want2, got2) {
+		t.Fatalf("want %#v, got %#v", want2, got2)
+	}
+}
+
+func TestFetchIPLiteral(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		t.Fatalf("expect lookup not to be called for %s", host)
+		return nil, 0, nil
+	}
+
+	cases := []struct {
+		addr string
+		want net.IP
+	}{
+		{"10.0.0.5", net.ParseIP("10.0.0.5")},
+		{"2001:db8::1", net.ParseIP("2001:db8::1")},
+		{"[2001:db8::1]", net.ParseIP("2001:db8::1")},
+	}
+
+	ctx := context.Background()
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	for _, tc := range cases {
+		t.Run(tc.addr, func(t *testing.T) {
+			for _, fn := range []func(context.Context, string) ([]net.IP, error){resolver.Fetch, resolver.LookupIP} {
+				got, err := fn(ctx, tc.addr)
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				if want := []net.IP{tc.want}; !reflect.DeepEqual(want, got) {
+					t.Fatalf("want %v, got %v", want, got)
+				}
+			}
+		})
+	}
+
+	if got := resolver.Len(); got != 0 {
+		t.Fatalf("expect IP literals not to be cached, got %d entries", got)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	ctx := context.Background()
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	for _, addr := range []string{"Example.com", "example.com", "example.com."} {
+		if _, err := resolver.Fetch(ctx, addr); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect lookup to be called once, called %d times", cnt)
+	}
+	if got := resolver.Len(); got != 1 {
+		t.Fatalf("expect one cache entry, got %d", got)
+	}
+
+	resolver.Remove("EXAMPLE.COM.")
+	if got := resolver.Len(); got != 0 {
+		t.Fatalf("expect entry to be removed, got %d", got)
+	}
+
+	cases := map[string]string{
+		"Example.COM.":       "example.com",
+		"xn--MNCHEN-3ya.de":  "xn--mnchen-3ya.de",
+		"MÜNCHEN.example":    "xn--mnchen-3ya.example",
+		"-ü.example":         "-ü.example",
+		"already.normalized": "already.normalized",
+		"Example.com.:443":   "example.com",
+		"[::1]:443":          "::1",
+		"::1":                "::1",
+	}
+	for in, want := range cases {
+		if got := NormalizeHost(in); got != want {
+			t.Fatalf("NormalizeHost(%q): want %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu     sync.Mutex
+		looked []string
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		looked = append(looked, host)
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	cases := []struct {
+		addr string
+		want net.IP
+	}{
+		{"example.com:443", net.IPv4(10, 0, 0, 1)},
+		{"example.com", net.IPv4(10, 0, 0, 1)},
+		{"[::1]:443", net.IPv6loopback},
+		{"[::1]", net.IPv6loopback},
+	}
+	for _, tc := range cases {
+		ips, err := resolver.LookupIP(context.Background(), tc.addr)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.addr, err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(tc.want) {
+			t.Fatalf("%s: want [%s], got %v", tc.addr, tc.want, ips)
+		}
+		if _, err := resolver.Fetch(context.Background(), tc.addr); err != nil {
+			t.Fatalf("%s: err: %s", tc.addr, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"example.com", "example.com"}; !reflect.DeepEqual(looked, want) {
+		t.Fatalf("expect the host without port to be looked up, got %v", looked)
+	}
+	if keys := resolver.cache.Keys(); !reflect.DeepEqual(keys, []string{"example.com"}) {
+		t.Fatalf("expect the host without port to be cached, got %v", keys)
+	}
+}
+
+func TestRefreshHost(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var mu sync.Mutex
+	var looked []string
+	var fail bool
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		looked = append(looked, host)
+		if fail {
+			return nil, 0, fmt.Errorf("err")
+		}
+		return []net.IPAddr{{IP: net.IP("4.4.4.4")}}, 0, nil
+	}
+
+	resolver := testResolver(t)
+	defer resolver.Stop()
+	resolver.cache = mapStore{
+		"deeeet.jp": {ips: []net.IP{net.IP("1.1.1.1")}},
+		"deeeet.us": {ips: []net.IP{net.IP("2.2.2.2")}},
+	}
+
+	if err := resolver.RefreshHost(context.Background(), "deeeet.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []string{"deeeet.jp"}; !reflect.DeepEqual(want, looked) {
+		t.Fatalf("want %v, got %v", want, looked)
+	}
+	if want, got := []net.IP{net.IP("4.4.4.4")}, getEntry(resolver, "deeeet.jp").ips; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if want, got := []net.IP{net.IP("2.2.2.2")}, getEntry(resolver, "deeeet.us").ips; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// The entry is kept on failure.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if err := resolver.RefreshHost(context.Background(), "deeeet.us"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+	if want, got := []net.IP{net.IP("2.2.2.2")}, getEntry(resolver, "deeeet.us").ips; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestRefreshContext(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	errFail := errors.New("err")
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		switch host {
+		case "fail.jp":
+			return nil, 0, errFail
+		case "slow.jp":
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		}
+		return []net.IPAddr{{IP: net.IP("4.4.4.4")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, time.Hour, WithHostTimeout("slow.jp", 100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+	resolver.cache = mapStore{
+		"deeeet.jp": {ips: []net.IP{net.IP("1.1.1.1")}},
+		"fail.jp":   {ips: []net.IP{net.IP("2.2.2.2")}},
+		"slow.jp":   {ips: []net.IP{net.IP("3.3.3.3")}},
+	}
+
+	err = resolver.RefreshContext(context.Background())
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+	if !errors.Is(err, errFail) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect joined errors, got %v", err)
+	}
+	for _, msg := range []string{"lookup fail.jp: err", "lookup slow.jp: context deadline exceeded"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("expect error %q to contain %q", err, msg)
+		}
+	}
+	if strings.Contains(err.Error(), "deeeet.jp") {
+		t.Fatalf("expect succeeded host not to be in error %q", err)
+	}
+
+	if want, got := []net.IP{net.IP("4.4.4.4")}, getEntry(resolver, "deeeet.jp").ips; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestRefreshContextCancel(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	ctx, cancelF := context.WithCancel(context.Background())
+	defer cancelF()
+
+	var called int32
+	lookupIP = func(lookupCtx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		// Cancel the refresh in the middle of the first lookup.
+		atomic.AddInt32(&called, 1)
+		cancelF()
+		<-lookupCtx.Done()
+		return nil, 0, lookupCtx.Err()
+	}
+
+	resolver, err := New(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+	resolver.cache = mapStore{
+		"a.jp": {ips: []net.IP{net.IP("1.1.1.1")}},
+		"b.jp": {ips: []net.IP{net.IP("2.2.2.2")}},
+		"c.jp": {ips: []net.IP{net.IP("3.3.3.3")}},
+		"d.jp": {ips: []net.IP{net.IP("4.4.4.4")}},
+	}
+
+	err = resolver.RefreshContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect cancelled error, got %v", err)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect the rest of hosts not to be looked up, called %d times", cnt)
+	}
+	if got := resolver.Stats().RefreshFailures; got != 0 {
+		t.Fatalf("expect cancellation not to count as failure, got %d", got)
+	}
+	if got := resolver.Len(); got != 4 {
+		t.Fatalf("expect entries to be kept, got %d", got)
+	}
+}
+
+func TestRefreshConcurrency(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var inflight, maxInflight int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInflight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInflight, m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		return []net.IPAddr{{IP: net.IP("4.4.4.4")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithRefreshConcurrency(4))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+	resolver.cache = make(mapStore)
+	for i := 0; i < 8; i++ {
+		resolver.cache.Set(fmt.Sprintf("host%d.jp", i), &Entry{ips: []net.IP{net.IP("1.1.1.1")}})
+	}
+
+	start := time.Now()
+	resolver.Refresh()
+	took := time.Since(start)
+
+	// 8 hosts by 4 workers takes 2 rounds of 100ms, while sequential refresh takes 800ms.
+	if took >= 500*time.Millisecond {
+		t.Fatalf("expect refresh to be parallelized, took %v", took)
+	}
+	if got := atomic.LoadInt32(&maxInflight); got > 4 {
+		t.Fatalf("expect at most 4 concurrent lookups, got %d", got)
+	}
+	for addr, entry := range resolver.cache.(mapStore) {
+		if want := []net.IP{net.IP("4.4.4.4")}; !reflect.DeepEqual(want, entry.ips) {
+			t.Fatalf("expect %s to be refreshed, got %v", addr, entry.ips)
+		}
+	}
+}
+
+func TestRefreshJitter(t *testing.T) {
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithRefreshJitter(0.1))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	freq := 10 * time.Second
+	min, max := 9*time.Second, 11*time.Second
+	var varied bool
+	for i := 0; i < 1000; i++ {
+		got := resolver.refreshInterval(freq)
+		if got < min || got > max {
+			t.Fatalf("expect interval within [%v, %v], got %v", min, max, got)
+		}
+		if got != freq {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Fatalf("expect interval to be randomized")
+	}
+}
+
+func TestRefreshJitterTick(t *testing.T) {
+	var counter int32
+	resolver, err := New(10*time.Millisecond, testDefaultLookupTimeout,
+		WithRefreshJitter(0.5),
+		WithOnRefreshed(func() {
+			atomic.AddInt32(&counter, 1)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// Each interval is between 5ms and 15ms.
+	if cnt := atomic.LoadInt32(&counter); cnt < 5 || cnt > 45 {
+		t.Fatalf("unexpected refresh count: %d", cnt)
+	}
+}
+
+func TestReady(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		time.Sleep(10 * time.Millisecond)
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	hosts := []string{"deeeet.jp", "deeeet.us", "deeeet.uk"}
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithInitialHosts(hosts))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	select {
+	case <-resolver.Ready():
+	case <-time.After(time.Second):
+		t.Fatalf("expect resolver to be ready")
+	}
+
+	for _, host := range hosts {
+		if _, ok := resolver.Entries()[host]; !ok {
+			t.Fatalf("expect %s to be cached", host)
+		}
+	}
+}
+
+func TestReadyWithoutInitialHosts(t *testing.T) {
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	select {
+	case <-resolver.Ready():
+	case <-time.After(time.Second):
+		t.Fatalf("expect resolver to be ready")
+	}
+}
+
+func TestInitialHostsBlocking(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var inflight, maxInflight int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInflight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInflight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if host == "fail.jp" {
+			return nil, 0, fmt.Errorf("err")
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	var hosts []string
+	for i := 0; i < 20; i++ {
+		hosts = append(hosts, fmt.Sprintf("host%d.jp", i))
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithInitialHosts(append(hosts, "fail.jp")),
+		WithBlockingWarmup(),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	entries := resolver.Entries()
+	for _, host := range hosts {
+		if _, ok := entries[host]; !ok {
+			t.Fatalf("expect %s to be cached", host)
+		}
+	}
+	if _, ok := entries["fail.jp"]; ok {
+		t.Fatalf("expect failed host not to be cached")
+	}
+	if got := atomic.LoadInt32(&maxInflight); got > warmupConcurrency {
+		t.Fatalf("expect at most %d concurrent lookups, got %d", warmupConcurrency, got)
+	}
+
+	select {
+	case <-resolver.Ready():
+	default:
+		t.Fatalf("expect resolver to be ready")
+	}
+}
+
+func TestNewWithContext(t *testing.T) {
+	var counter int32
+	ctx, cancelF := context.WithCancel(context.Background())
+	resolver := NewWithContext(ctx, 1*time.Millisecond, testDefaultLookupTimeout, WithOnRefreshed(func() {
+		atomic.AddInt32(&counter, 1)
+	}))
+
+	time.Sleep(10 * time.Millisecond)
+	if cnt := atomic.LoadInt32(&counter); cnt == 0 {
+		t.Fatalf("expect to be refreshed")
+	}
+
+	cancelF()
+	time.Sleep(10 * time.Millisecond)
+	cnt1 := atomic.LoadInt32(&counter)
+	time.Sleep(10 * time.Millisecond)
+	if cnt2 := atomic.LoadInt32(&counter); cnt1 != cnt2 {
+		t.Fatalf("expect refreshing to be stopped: %d -> %d", cnt1, cnt2)
+	}
+
+	select {
+	case <-resolver.Done():
+	default:
+		t.Fatalf("expect refreshing to be stopped")
+	}
+
+	// Stop is still safe to call.
+	resolver.Stop()
+	resolver.Stop()
+}
+
+func TestStop(t *testing.T) {
+	resolver := testResolver(t)
+	if !resolver.IsRunning() {
+		t.Fatalf("expect resolver to be running")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resolver.Stop()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-resolver.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expect refreshing to be stopped")
+	}
+	if resolver.IsRunning() {
+		t.Fatalf("expect resolver not to be running")
+	}
+	resolver.Stop()
+}
+
+func TestRemoveFailedHosts(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var fail int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	t.Run("Threshold", func(t *testing.T) {
+		resolver, err := New(time.Hour, testDefaultLookupTimeout, WithRemoveFailedHosts(3))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer resolver.Stop()
+
+		atomic.StoreInt32(&fail, 0)
+		if _, err := resolver.Fetch(context.Background(), "failed.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// Two failures, then success resets the counter.
+		atomic.StoreInt32(&fail, 1)
+		resolver.Refresh()
+		resolver.Refresh()
+		atomic.StoreInt32(&fail, 0)
+		resolver.Refresh()
+		if got := resolver.HostStats("failed.jp").ConsecutiveFailures; got != 0 {
+			t.Fatalf("expect failure count to be reset, got %d", got)
+		}
+
+		atomic.StoreInt32(&fail, 1)
+		resolver.Refresh()
+		resolver.Refresh()
+		if _, ok := resolver.cache.Get("failed.jp"); !ok {
+			t.Fatalf("expect host to be kept below threshold")
+		}
+		resolver.Refresh()
+		if _, ok := resolver.cache.Get("failed.jp"); ok {
+			t.Fatalf("expect host to be removed at threshold")
+		}
+	})
+
+	t.Run("Immediate", func(t *testing.T) {
+		resolver, err := New(time.Hour, testDefaultLookupTimeout, WithRemoveFailedHosts(1))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer resolver.Stop()
+
+		atomic.StoreInt32(&fail, 0)
+		if _, err := resolver.Fetch(context.Background(), "failed.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		atomic.StoreInt32(&fail, 1)
+		resolver.Refresh()
+		if _, ok := resolver.cache.Get("failed.jp"); ok {
+			t.Fatalf("expect host to be removed on first failure")
+		}
+	})
+}
+
+func TestEvictOnErrors(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	errCustom := errors.New("custom")
+	var (
+		mu        sync.Mutex
+		lookupErr error
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return nil, 0, lookupErr
+	}
+
+	cases := []struct {
+		name    string
+		err     error
+		options []Option
+		evicted bool
+	}{
+		{
+			name:    "NotFound",
+			err:     &net.DNSError{Err: "no such host", Name: "evict.jp", IsNotFound: true},
+			options: []Option{WithRemoveFailedHosts(1)},
+			evicted: true,
+		},
+		{
+			name:    "Timeout",
+			err:     &net.DNSError{Err: "i/o timeout", Name: "evict.jp", IsTimeout: true},
+			options: []Option{WithRemoveFailedHosts(1)},
+			evicted: false,
+		},
+		{
+			name:    "Temporary",
+			err:     &net.DNSError{Err: "server misbehaving", Name: "evict.jp", IsTemporary: true},
+			options: []Option{WithRemoveFailedHosts(1)},
+			evicted: false,
+		},
+		{
+			name: "CustomPredicate",
+			err:  errCustom,
+			options: []Option{WithEvictOnErrors(func(err error) bool {
+				return errors.Is(err, errCustom)
+			})},
+			evicted: true,
+		},
+		{
+			name: "CustomPredicateNotMatched",
+			err:  &net.DNSError{Err: "no such host", Name: "evict.jp", IsNotFound: true},
+			options: []Option{WithRemoveFailedHosts(1), WithEvictOnErrors(func(err error) bool {
+				return errors.Is(err, errCustom)
+			})},
+			evicted: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver, err := New(time.Hour, testDefaultLookupTimeout, tc.options...)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer resolver.Stop()
+			resolver.cache.Set("evict.jp", &Entry{ips: []net.IP{net.IP("10.0.0.1")}})
+
+			mu.Lock()
+			lookupErr = tc.err
+			mu.Unlock()
+			resolver.Refresh()
+
+			if _, ok := resolver.cache.Get("evict.jp"); ok == tc.evicted {
+				t.Fatalf("want evicted %v, got %v", tc.evicted, !ok)
+			}
+		})
+	}
+}
+
+func TestLookupError(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	_, err := resolver.Fetch(context.Background(), "unknown.jp")
+
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) {
+		t.Fatalf("expect LookupError, got %#v", err)
+	}
+	if got, want := lookupErr.Host, "unknown.jp"; got != want {
+		t.Fatalf("want host %q, got %q", want, got)
+	}
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expect underlying DNSError, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "unknown.jp") {
+		t.Fatalf("expect error %q to contain host", err)
+	}
+}
+
+func TestLookupRetries(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		called   int32
+		failures int32
+		failErr  error
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if atomic.AddInt32(&called, 1) <= atomic.LoadInt32(&failures) {
+			return nil, 0, failErr
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	cases := []struct {
+		name     string
+		failures int32
+		err      error
+		timeout  time.Duration
+		wantErr  bool
+		want     int32
+	}{
+		{
+			name:     "SucceedAfterRetry",
+			failures: 2,
+			err:      &net.DNSError{Err: "server misbehaving", IsTemporary: true},
+			want:     3,
+		},
+		{
+			name:     "ExceedRetries",
+			failures: 5,
+			err:      &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+			wantErr:  true,
+			want:     4,
+		},
+		{
+			name:     "NotFound",
+			failures: 5,
+			err:      &net.DNSError{Err: "no such host", IsNotFound: true},
+			wantErr:  true,
+			want:     1,
+		},
+		// The retries stop when the lookup timeout elapses, before the third lookup
+		// after the backoff doubled to 20ms.
+		{
+			name:     "Deadline",
+			failures: 5,
+			err:      &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+			timeout:  25 * time.Millisecond,
+			wantErr:  true,
+			want:     2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&called, 0)
+			atomic.StoreInt32(&failures, tc.failures)
+			failErr = tc.err
+
+			timeout := testDefaultLookupTimeout
+			if tc.timeout > 0 {
+				timeout = tc.timeout
+			}
+			resolver, err := New(time.Hour, timeout, WithLookupRetries(3, 10*time.Millisecond))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer resolver.Stop()
+
+			_, err = resolver.LookupIP(context.Background(), "retry.jp")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, got %v", tc.wantErr, err)
+			}
+			if got := atomic.LoadInt32(&called); got != tc.want {
+				t.Fatalf("want %d lookups, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHostTimeout(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu        sync.Mutex
+		remaining = make(map[string]time.Duration)
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Errorf("expect lookup context to have deadline")
+		}
+		mu.Lock()
+		remaining[host] = time.Until(deadline)
+		mu.Unlock()
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, time.Hour, WithHostTimeout("Slow.jp.", time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, nil
+	}
+	for _, host := range []string{"slow.jp", "fast.jp"} {
+		if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", host+":443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if got := remaining["slow.jp"]; got <= 0 || got > time.Minute {
+		t.Fatalf("expect host timeout to be used for dial, got %v", got)
+	}
+	if got := remaining["fast.jp"]; got <= time.Minute {
+		t.Fatalf("expect global timeout to be used for dial, got %v", got)
+	}
+
+	resolver.Refresh()
+	if got := remaining["slow.jp"]; got <= 0 || got > time.Minute {
+		t.Fatalf("expect host timeout to be used for refresh, got %v", got)
+	}
+	if got := remaining["fast.jp"]; got <= time.Minute {
+		t.Fatalf("expect global timeout to be used for refresh, got %v", got)
+	}
+}
+
+func TestFetchMany(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		if host == "fail.jp" {
+			return nil, 0, fmt.Errorf("err")
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.2")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithStaticEntries(map[string][]net.IP{
+		"cached.jp": {net.IP("10.0.0.1")},
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	got, err := resolver.FetchMany(context.Background(), []string{"cached.jp", "a.jp", "b.jp", "fail.jp"})
+	if err == nil || !strings.Contains(err.Error(), "fail.jp") {
+		t.Fatalf("expect error of fail.jp, got %v", err)
+	}
+
+	want := map[string][]net.IP{
+		"cached.jp": {net.IP("10.0.0.1")},
+		"a.jp":      {net.IP("10.0.0.2")},
+		"b.jp":      {net.IP("10.0.0.2")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if got := atomic.LoadInt32(&called); got != 3 {
+		t.Fatalf("want 3 lookups, got %d", got)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if ips, ok := resolver.Peek("peek.jp"); ok || ips != nil {
+		t.Fatalf("expect miss, got %v", ips)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 0 {
+		t.Fatalf("expect no lookup on miss, called %d times", cnt)
+	}
+
+	if _, err := resolver.Fetch(context.Background(), "peek.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ips, ok := resolver.Peek("PEEK.jp.")
+	if !ok {
+		t.Fatalf("expect hit")
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(ips, want) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+
+	resolver.Invalidate("peek.jp")
+	if _, ok := resolver.Peek("peek.jp"); ok {
+		t.Fatalf("expect invalidated entry to be missed")
+	}
+	if ips, ok := resolver.Peek("10.0.0.2"); !ok || !ips[0].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("expect IP literal, got %v", ips)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect only Fetch to lookup, called %d times", cnt)
+	}
+	if got := resolver.Stats().CacheHits; got != 0 {
+		t.Fatalf("expect Peek not to count, got %d hits", got)
+	}
+}
+
+func TestFetchWithMeta(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	before := time.Now()
+	_, meta, err := resolver.FetchWithMeta(context.Background(), "meta.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if meta.Hit {
+		t.Fatalf("expect first fetch to miss the cache")
+	}
+	if meta.LastRefreshed.Before(before) {
+		t.Fatalf("expect LastRefreshed to be set, got %v", meta.LastRefreshed)
+	}
+	refreshed := meta.LastRefreshed
+
+	_, meta, err = resolver.FetchWithMeta(context.Background(), "meta.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !meta.Hit {
+		t.Fatalf("expect second fetch to hit the cache")
+	}
+	if !meta.LastRefreshed.Equal(refreshed) {
+		t.Fatalf("want LastRefreshed %v, got %v", refreshed, meta.LastRefreshed)
+	}
+}
+
+func TestRefreshKeepsUnchangedIPs(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu  sync.Mutex
+		ips = []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ipAddrsOf(copyIPs(ips)), 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.LookupIP(context.Background(), "keep.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cachedIPs := func() []net.IP {
+		resolver.lock.RLock()
+		defer resolver.lock.RUnlock()
+		return getEntry(resolver, "keep.jp").ips
+	}
+	before := cachedIPs()
+
+	// Same IP set in the different order.
+	mu.Lock()
+	ips = []net.IP{net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 1)}
+	mu.Unlock()
+	resolver.Refresh()
+	if after := cachedIPs(); &after[0] != &before[0] {
+		t.Fatalf("expect cached IP list to be reused")
+	}
+
+	mu.Lock()
+	ips = []net.IP{net.IPv4(10, 0, 0, 3)}
+	mu.Unlock()
+	resolver.Refresh()
+	if after := cachedIPs(); !reflect.DeepEqual(after, ips) {
+		t.Fatalf("want %v, got %v", ips, after)
+	}
+}
+
+func TestOnIPsChanged(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu  sync.Mutex
+		ips = []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ipAddrsOf(copyIPs(ips)), 0, nil
+	}
+
+	type change struct {
+		host           string
+		added, removed []net.IP
+	}
+	var changes []change
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithOnIPsChanged(func(host string, added, removed []net.IP) {
+		changes = append(changes, change{host: host, added: added, removed: removed})
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.LookupIP(context.Background(), "change.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resolver.Refresh()
+	if len(changes) != 0 {
+		t.Fatalf("expect no change to be reported, got %v", changes)
+	}
+
+	mu.Lock()
+	ips = []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}
+	mu.Unlock()
+	resolver.Refresh()
+
+	want := []change{{
+		host:    "change.jp",
+		added:   []net.IP{net.IPv4(10, 0, 0, 3)},
+		removed: []net.IP{net.IPv4(10, 0, 0, 1)},
+	}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("want %v, got %v", want, changes)
+	}
+}
+
+func TestOnLookupError(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var fail atomic.Bool
+	lookupErr := errors.New("err")
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "fail.jp" || fail.Load() {
+			return nil, 0, lookupErr
+		}
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	var (
+		resolver *Resolver
+		hosts    []string
+	)
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithOnLookupError(func(host string, err error) {
+		// The resolver can be called without deadlock.
+		_ = resolver.Len()
+		var lookupError *LookupError
+		if !errors.As(err, &lookupError) || lookupError.Host != host || !errors.Is(err, lookupErr) {
+			t.Errorf("unexpected error of %s: %v", host, err)
+		}
+		hosts = append(hosts, host)
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "fail.jp"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+	if _, err := resolver.Fetch(context.Background(), "refresh.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fail.Store(true)
+	resolver.Refresh()
+
+	if want := []string{"fail.jp", "refresh.jp"}; !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("want %v, got %v", want, hosts)
+	}
+}
+
+func TestStableSort(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		ips := []net.IP{
+			net.ParseIP("2001:db8::1"),
+			net.IPv4(10, 0, 0, 2),
+			net.IPv4(10, 0, 0, 1).To4(),
+			net.ParseIP("::1"),
+			net.IPv4(9, 0, 0, 1),
+		}
+		rand.Shuffle(len(ips), func(i, j int) {
+			ips[i], ips[j] = ips[j], ips[i]
+		})
+		return ipAddrsOf(ips), 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithStableSort(true))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	want := []string{"::1", "9.0.0.1", "10.0.0.1", "10.0.0.2", "2001:db8::1"}
+	for i := 0; i < 10; i++ {
+		resolver.Remove("sort.jp")
+		ips, err := resolver.Fetch(context.Background(), "sort.jp")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		got := make([]string, len(ips))
+		for i, ip := range ips {
+			got[i] = ip.String()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDedupeIPs(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{
+			{IP: net.IPv4(10, 0, 0, 2)},
+			{IP: net.IPv4(10, 0, 0, 1)},
+			{IP: net.IPv4(10, 0, 0, 2).To4()},
+			{IP: net.ParseIP("2001:db8::1")},
+			{IP: net.IPv4(10, 0, 0, 1)},
+			{IP: net.ParseIP("2001:db8::1")},
+		}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ips, err := resolver.Fetch(context.Background(), "dup.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1), net.ParseIP("2001:db8::1")}
+	if !reflect.DeepEqual(ips, want) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if got := getEntry(resolver, "dup.jp").ips; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want cached %v, got %v", want, got)
+	}
+}
+
+// recordingHandler is a `slog.Handler` which records the messages and the attributes.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []map[string]any
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	attrs := map[string]any{"msg": record.Message}
+	record.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.Any()
+		return true
+	})
+	h.mu.Lock()
+	h.records = append(h.records, attrs)
+	h.mu.Unlock()
+	return nil
+}
+
+func TestDebugLogs(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(10, 0, 0, 2)}}, 0, nil
+	}
+
+	handler := &recordingHandler{}
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithLogger(slog.New(handler)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Fetch(context.Background(), "log.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	resolver.Refresh()
+
+	want := []map[string]any{
+		{"msg": "DNS cache miss", "addr": "log.jp"},
+		{"msg": "looking up DNS", "addr": "log.jp"},
+		{"msg": "looked up DNS", "addr": "log.jp", "ips": int64(2)},
+		{"msg": "DNS cache hit", "addr": "log.jp"},
+		{"msg": "looking up DNS", "addr": "log.jp"},
+		{"msg": "looked up DNS", "addr": "log.jp", "ips": int64(2)},
+		{"msg": "refreshed DNS cache", "hosts": int64(1), "failures": int64(0)},
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.records) != len(want) {
+		t.Fatalf("want %d records, got %v", len(want), handler.records)
+	}
+	for i, record := range handler.records {
+		for k, v := range want[i] {
+			if record[k] != v {
+				t.Fatalf("want %s=%v in record %d, got %v", k, v, i, record)
+			}
+		}
+	}
+	if _, ok := handler.records[2]["duration"].(time.Duration); !ok {
+		t.Fatalf("expect lookup duration to be logged, got %v", handler.records[2])
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Millisecond, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+	if _, err := resolver.Fetch(context.Background(), "swap.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Swap the logger while the refresh goroutine and the other refreshes run.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			resolver.Refresh()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		resolver.SetLogger(slog.New(&recordingHandler{}))
+	}
+	wg.Wait()
+
+	handler := &recordingHandler{}
+	resolver.SetLogger(slog.New(handler))
+	resolver.Refresh()
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.records) == 0 {
+		t.Fatalf("expect the swapped logger to be used")
+	}
+}
+
+func TestWithLoggerHandler(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var failing atomic.Bool
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if failing.Load() {
+			return nil, 0, errors.New("err")
+		}
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	handler := &recordingHandler{}
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithLogger(slog.New(handler)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, nil
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "handler.jp:443"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	failing.Store(true)
+	resolver.Refresh()
+
+	find := func(msg string) map[string]any {
+		t.Helper()
+		handler.mu.Lock()
+		defer handler.mu.Unlock()
+		for _, record := range handler.records {
+			if record["msg"] == msg {
+				return record
+			}
+		}
+		t.Fatalf("expect %q to be logged, got %v", msg, handler.records)
+		return nil
+	}
+	if record := find("dialed cached IP"); record["addr"] != "handler.jp:443" || record["ip"] != "10.0.0.1" {
+		t.Fatalf("want the dialed IP to be logged, got %v", record)
+	}
+	record := find("failed to refresh DNS cache")
+	if record["addr"] != "handler.jp" {
+		t.Fatalf("want the failed host to be logged, got %v", record)
+	}
+	if err, ok := record["error"].(error); !ok || !strings.Contains(err.Error(), "err") {
+		t.Fatalf("want the refresh error to be logged, got %v", record)
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu      sync.Mutex
+		queried []time.Time
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		queried = append(queried, time.Now())
+		mu.Unlock()
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithQueryRateLimit(20))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	hosts := []string{"a.jp", "b.jp", "c.jp", "d.jp", "e.jp"}
+	if _, err := resolver.FetchMany(context.Background(), hosts); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resolver.Refresh()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queried) != 10 {
+		t.Fatalf("want 10 queries, got %d", len(queried))
+	}
+	sort.Slice(queried, func(i, j int) bool {
+		return queried[i].Before(queried[j])
+	})
+	// 20 queries per second are spaced by 50ms. Allow some slack of the timer.
+	if took, want := queried[9].Sub(queried[0]), 9*50*time.Millisecond; took < want-10*time.Millisecond {
+		t.Fatalf("expect the queries to take at least %v, took %v", want, took)
+	}
+
+	// The lookup waiting for its turn is cancelled by the context.
+	ctx, cancelF := context.WithCancel(context.Background())
+	cancelF()
+	if _, err := resolver.LookupIP(ctx, "f.jp"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect cancelled error, got %v", err)
+	}
+}
+
+func TestMaxConcurrentLookups(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var inFlight, maxInFlight int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithMaxConcurrentLookups(3),
+		WithRefreshConcurrency(10),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := resolver.Fetch(context.Background(), fmt.Sprintf("host%d.jp", i)); err != nil {
+				t.Errorf("err: %s", err)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resolver.Refresh()
+	}()
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&maxInFlight); got != 3 {
+		t.Fatalf("expect at most 3 lookups in flight, got %d", got)
+	}
+
+	// The lookup waiting for a slot is cancelled by the context.
+	ctx, cancelF := context.WithCancel(context.Background())
+	cancelF()
+	if _, err := resolver.LookupIP(ctx, "cancel.jp"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect cancelled error, got %v", err)
+	}
+}
+
+func TestIDNHost(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu     sync.Mutex
+		called []string
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		called = append(called, host)
+		mu.Unlock()
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for _, host := range []string{"münchen.example", "MÜNCHEN.example.", "xn--mnchen-3ya.example"} {
+		if _, err := resolver.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if want := []string{"xn--mnchen-3ya.example"}; !reflect.DeepEqual(called, want) {
+		t.Fatalf("expect one lookup of %v, got %v", want, called)
+	}
+	if _, ok := resolver.Peek("münchen.example"); !ok {
+		t.Fatalf("expect the unicode host to hit the cache")
+	}
+
+	var lookupErr *LookupError
+	if _, err := resolver.Fetch(context.Background(), "-ü.example"); !errors.As(err, &lookupErr) || lookupErr.Host != "-ü.example" {
+		t.Fatalf("expect lookup error of the malformed host, got %v", err)
+	}
+	if len(called) != 1 {
+		t.Fatalf("expect the malformed host not to be looked up, got %v", called)
+	}
+}
+
+func TestDump(t *testing.T) {
+	refreshedAt := time.Date(2018, 11, 13, 0, 0, 0, 0, time.UTC)
+	resolver := &Resolver{
+		cache: mapStore{
+			"b.jp":      {ips: []net.IP{net.IPv4(10, 0, 0, 2), net.ParseIP("2001:db8::2")}, refreshedAt: refreshedAt},
+			"a.jp":      {ips: []net.IP{net.IPv4(10, 0, 0, 1)}, refreshedAt: refreshedAt},
+			"static.jp": {ips: []net.IP{net.IPv4(10, 0, 0, 3)}, static: true},
+		},
+	}
+
+	want := "a.jp=[10.0.0.1](refreshed 2018-11-13T00:00:00Z) " +
+		"b.jp=[10.0.0.2 2001:db8::2](refreshed 2018-11-13T00:00:00Z) " +
+		"static.jp=[10.0.0.3](static)"
+	if got := resolver.Dump(); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestHostAllowlist(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var mu sync.Mutex
+	called := make(map[string]int)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		called[host]++
+		mu.Unlock()
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithHostAllowlist([]string{"*.Internal", "api.example.com"}),
+		WithHostDenylist([]string{"secret.internal"}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	hosts := []string{"db.internal", "api.example.com", "internal", "other.example.com", "secret.internal"}
+	for i := 0; i < 2; i++ {
+		for _, host := range hosts {
+			ips, err := resolver.Fetch(context.Background(), host)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(ips, want) {
+				t.Fatalf("want %v, got %v", want, ips)
+			}
+		}
+	}
+
+	want := map[string]int{
+		"db.internal":       1,
+		"api.example.com":   1,
+		"internal":          2,
+		"other.example.com": 2,
+		"secret.internal":   2,
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(called, want) {
+		t.Fatalf("want %v, got %v", want, called)
+	}
+	mu.Unlock()
+	if got := resolver.Len(); got != 2 {
+		t.Fatalf("expect only the allowed hosts to be cached, got %v", resolver.Entries())
+	}
+
+	// DialFunc dials the hosts which are not cached as they are.
+	var dialed []string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, nil
+	}
+	for _, addr := range []string{"db.internal:443", "other.example.com:443"} {
+		if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", addr); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if want := []string{"10.0.0.1:443", "other.example.com:443"}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("want %v, got %v", want, dialed)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		switch host {
+		case "mixed.jp":
+			return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(127, 0, 0, 1)}, {IP: net.IPv4(203, 0, 113, 1)}}, 0, nil
+		default:
+			return []net.IPAddr{{IP: net.IPv4(192, 168, 0, 1)}, {IP: net.ParseIP("::1")}}, 0, nil
+		}
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithIPFilter(ExcludePrivate),
+		WithIPFilter(ExcludeLoopback),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	got, err := resolver.LookupIP(context.Background(), "mixed.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(203, 0, 113, 1)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	_, err = resolver.LookupIP(context.Background(), "internal.jp")
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) || lookupErr.Host != "internal.jp" {
+		t.Fatalf("expect LookupError when all IPs are filtered, got %v", err)
+	}
+	if _, ok := resolver.Entries()["internal.jp"]; ok {
+		t.Fatalf("expect filtered host not to be cached")
+	}
+}
+
+func TestMaxIPsPerHost(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu  sync.Mutex
+		ips []net.IP
+	)
+	for i := 0; i < 100; i++ {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i)))
+	}
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ipAddrsOf(copyIPs(ips)), 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithMaxIPsPerHost(3))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	got, err := resolver.LookupIP(context.Background(), "wildcard.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("want 3 IPs, got %d", len(got))
+	}
+	if cached := resolver.Entries()["wildcard.jp"]; len(cached) != 3 {
+		t.Fatalf("want 3 cached IPs, got %d", len(cached))
+	}
+
+	// The sample is kept while the IPs are still returned.
+	resolver.Refresh()
+	if cached := resolver.Entries()["wildcard.jp"]; !reflect.DeepEqual(cached, got) {
+		t.Fatalf("want %v, got %v", got, cached)
+	}
+
+	mu.Lock()
+	ips = append([]net.IP{got[0]}, ips[100:]...)
+	ips = append(ips, net.IPv4(10, 0, 1, 1), net.IPv4(10, 0, 1, 2), net.IPv4(10, 0, 1, 3))
+	mu.Unlock()
+	resolver.Refresh()
+	cached := resolver.Entries()["wildcard.jp"]
+	if len(cached) != 3 || !cached[0].Equal(got[0]) {
+		t.Fatalf("expect %v to be kept in 3 IPs, got %v", got[0], cached)
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	originalFunc, originalCNAMEFunc := lookupIP, lookupCNAME
+	defer func() {
+		lookupIP, lookupCNAME = originalFunc, originalCNAMEFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		if host == "alias.jp" {
+			return "target.example.com.", nil
+		}
+		return "", errors.New("err")
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithCanonicalName())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for _, hit := range []bool{false, true} {
+		_, meta, err := resolver.FetchWithMeta(context.Background(), "alias.jp")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if meta.Hit != hit {
+			t.Fatalf("want hit %v, got %v", hit, meta.Hit)
+		}
+		if want := "target.example.com"; meta.CanonicalName != want {
+			t.Fatalf("want canonical name %q, got %q", want, meta.CanonicalName)
+		}
+	}
+
+	// Failing to lookup the canonical name does not fail the lookup.
+	_, meta, err := resolver.FetchWithMeta(context.Background(), "other.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if meta.CanonicalName != "" {
+		t.Fatalf("expect no canonical name, got %q", meta.CanonicalName)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "unknown.jp" {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for i := 0; i < 2; i++ {
+		err := resolver.Warmup(context.Background(), "a.jp", "unknown.jp", "b.jp")
+		var lookupErr *LookupError
+		if !errors.As(err, &lookupErr) || lookupErr.Host != "unknown.jp" {
+			t.Fatalf("expect LookupError of unknown.jp, got %v", err)
+		}
+
+		entries := resolver.Entries()
+		if len(entries) != 2 {
+			t.Fatalf("want 2 entries, got %v", entries)
+		}
+		for _, host := range []string{"a.jp", "b.jp"} {
+			if _, ok := entries[host]; !ok {
+				t.Fatalf("expect %s to be cached", host)
+			}
+		}
+	}
+
+	if err := resolver.Warmup(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	var (
+		mu      sync.Mutex
+		evicted []string
+	)
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithCacheSize(3),
+		WithOnEvict(func(host string) {
+			mu.Lock()
+			defer mu.Unlock()
+			evicted = append(evicted, host)
+		}),
+		WithStaticEntries(map[string][]net.IP{
+			"static.jp": {net.IP("10.0.0.2")},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	fetch := func(host string) {
+		t.Helper()
+		if _, err := resolver.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	hosts := func() []string {
+		var hosts []string
+		for host := range resolver.Entries() {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		return hosts
+	}
+
+	fetch("a.jp")
+	fetch("b.jp")
+	fetch("c.jp")
+	// a.jp becomes the most recently fetched.
+	fetch("a.jp")
+
+	fetch("d.jp")
+	if want := []string{"a.jp", "c.jp", "d.jp", "static.jp"}; !reflect.DeepEqual(hosts(), want) {
+		t.Fatalf("expect the least recently fetched b.jp to be evicted, want %v, got %v", want, hosts())
+	}
+
+	// Removed hosts do not count.
+	resolver.Remove("c.jp")
+	fetch("e.jp")
+	if want := []string{"a.jp", "d.jp", "e.jp", "static.jp"}; !reflect.DeepEqual(hosts(), want) {
+		t.Fatalf("want %v, got %v", want, hosts())
+	}
+
+	// Refreshing does not change the order.
+	resolver.Refresh()
+	fetch("f.jp")
+	if want := []string{"d.jp", "e.jp", "f.jp", "static.jp"}; !reflect.DeepEqual(hosts(), want) {
+		t.Fatalf("want %v, got %v", want, hosts())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"b.jp", "a.jp"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("want evicted %v, got %v", want, evicted)
+	}
+}
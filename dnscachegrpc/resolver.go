@@ -0,0 +1,193 @@
+// Package dnscachegrpc provides a gRPC name resolver backed by go-dnscache.
+package dnscachegrpc // import "go.mercari.io/go-dnscache/dnscachegrpc"
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+
+	dnscache "go.mercari.io/go-dnscache"
+)
+
+// Scheme is the scheme of the targets which the Builder resolves,
+// e.g. "dnscache:///service.example.com:50051".
+const Scheme = "dnscache"
+
+// fetchTimeout is the timeout of fetching the IP list for the client connection.
+const fetchTimeout = 10 * time.Second
+
+// defaultPort is used when the target has no port, which is the same as
+// the default of the gRPC DNS resolver.
+const defaultPort = "443"
+
+// Builder is a gRPC `resolver.Builder` which resolves the targets by the DNS cache.
+// The gRPC client connections receive the new addresses when the IP set of the host
+// changes on refresh.
+type Builder struct {
+	resolver *dnscache.Resolver
+
+	mu       sync.Mutex
+	watchers map[string]map[*grpcResolver]struct{}
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+// NewBuilder starts a new `dnscache.Resolver` with the given arguments which are the
+// same as `dnscache.New`, and returns a Builder resolving by it. Register the builder
+// by `resolver.Register` or pass it by `grpc.WithResolvers` to use it.
+//
+// The hosts of the targets are fetched again when they are evicted by
+// `dnscache.WithMaxEntryAge` or `dnscache.WithCacheSize` option, so that the client
+// connections keep receiving the changes. The cache size should be larger than the
+// number of the hosts of the targets, otherwise they evict each other.
+func NewBuilder(freq, lookupTimeout time.Duration, options ...dnscache.Option) (*Builder, error) {
+	b := &Builder{
+		watchers: make(map[string]map[*grpcResolver]struct{}),
+	}
+
+	options = append(options, dnscache.WithOnIPsChanged(b.onIPsChanged), dnscache.WithOnEvict(b.onEvict))
+	r, err := dnscache.New(freq, lookupTimeout, options...)
+	if err != nil {
+		return nil, err
+	}
+	b.resolver = r
+	return b, nil
+}
+
+// Resolver returns the DNS cache resolver used by the builder. Call its `Stop`
+// to stop refreshing.
+func (b *Builder) Resolver() *dnscache.Resolver {
+	return b.resolver
+}
+
+// Scheme implements `resolver.Builder`.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build implements `resolver.Builder`. The addresses are fetched in the background,
+// so that it does not block creating the client connection.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	host, port, err := splitHostPort(target.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &grpcResolver{
+		builder: b,
+		host:    dnscache.NormalizeHost(host),
+		port:    port,
+		cc:      cc,
+	}
+
+	b.mu.Lock()
+	if b.watchers[r.host] == nil {
+		b.watchers[r.host] = make(map[*grpcResolver]struct{})
+	}
+	b.watchers[r.host][r] = struct{}{}
+	b.mu.Unlock()
+
+	go r.update()
+	return r, nil
+}
+
+// onIPsChanged is called by the resolver when the IP set of the host changes.
+func (b *Builder) onIPsChanged(host string, _, _ []net.IP) {
+	for _, r := range b.watchersOf(host) {
+		r.update()
+	}
+}
+
+// onEvict is called by the resolver when the host is evicted from the cache. The watched
+// host is fetched again since no change is notified until it is cached again.
+func (b *Builder) onEvict(host string) {
+	for _, r := range b.watchersOf(host) {
+		go r.update()
+	}
+}
+
+// watchersOf returns the resolvers watching the given host.
+func (b *Builder) watchersOf(host string) []*grpcResolver {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	watchers := make([]*grpcResolver, 0, len(b.watchers[host]))
+	for r := range b.watchers[host] {
+		watchers = append(watchers, r)
+	}
+	return watchers
+}
+
+// grpcResolver is a gRPC `resolver.Resolver` of a target.
+type grpcResolver struct {
+	builder *Builder
+	host    string
+	port    string
+	cc      resolver.ClientConn
+
+	// mu serializes the updates of the client connection.
+	mu     sync.Mutex
+	closed bool
+}
+
+var _ resolver.Resolver = (*grpcResolver)(nil)
+
+// update fetches the IP list of the host and pushes the addresses to the client connection.
+func (r *grpcResolver) update() {
+	ctx, cancelF := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancelF()
+	ips, err := r.builder.resolver.Fetch(ctx, r.host)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if err != nil {
+		r.cc.ReportError(err)
+		return
+	}
+
+	addrs := make([]resolver.Address, len(ips))
+	for i, ip := range ips {
+		addrs[i] = resolver.Address{Addr: net.JoinHostPort(ip.String(), r.port), ServerName: r.host}
+	}
+	// The error means the addresses are rejected by the balancer, which keeps the last
+	// addresses. The next change of the IP set or ResolveNow pushes the addresses again.
+	_ = r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+// ResolveNow implements `resolver.Resolver`. It pushes the cached addresses again.
+func (r *grpcResolver) ResolveNow(resolver.ResolveNowOptions) {
+	go r.update()
+}
+
+// Close implements `resolver.Resolver`.
+func (r *grpcResolver) Close() {
+	r.builder.mu.Lock()
+	delete(r.builder.watchers[r.host], r)
+	if len(r.builder.watchers[r.host]) == 0 {
+		delete(r.builder.watchers, r.host)
+	}
+	r.builder.mu.Unlock()
+
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+}
+
+// splitHostPort splits the endpoint of the target into the host and the port.
+// If the endpoint has no port, the default port is used.
+func splitHostPort(endpoint string) (string, string, error) {
+	if host, port, err := net.SplitHostPort(endpoint); err == nil {
+		return host, port, nil
+	}
+	// The endpoint without port, including IPv6 address without brackets.
+	if endpoint == "" {
+		return "", "", &net.AddrError{Err: "missing address", Addr: endpoint}
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]"), defaultPort, nil
+}
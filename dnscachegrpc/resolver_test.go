@@ -0,0 +1,186 @@
+package dnscachegrpc
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	dnscache "go.mercari.io/go-dnscache"
+)
+
+// testClientConn is a `resolver.ClientConn` which records the pushed states.
+type testClientConn struct {
+	resolver.ClientConn
+
+	states chan resolver.State
+}
+
+func (cc *testClientConn) UpdateState(s resolver.State) error {
+	cc.states <- s
+	return nil
+}
+
+func (cc *testClientConn) ReportError(err error) {}
+
+func (cc *testClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+func addrs(s resolver.State) []string {
+	got := make([]string, len(s.Addresses))
+	for i, addr := range s.Addresses {
+		got[i] = addr.Addr
+	}
+	return got
+}
+
+func TestBuilder(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ips = []net.IP{net.IPv4(10, 0, 0, 1)}
+	)
+	builder, err := NewBuilder(time.Hour, time.Second, dnscache.WithLookupIPFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ips, nil
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer builder.Resolver().Stop()
+
+	if got := builder.Scheme(); got != Scheme {
+		t.Fatalf("want scheme %q, got %q", Scheme, got)
+	}
+
+	cc := &testClientConn{states: make(chan resolver.State, 10)}
+	target := resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/Backend.Test:50051"}}
+	r, err := builder.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	next := func() resolver.State {
+		t.Helper()
+		select {
+		case s := <-cc.states:
+			return s
+		case <-time.After(time.Second):
+			t.Fatalf("expect state to be updated")
+			return resolver.State{}
+		}
+	}
+
+	s := next()
+	if want := []string{"10.0.0.1:50051"}; !reflect.DeepEqual(addrs(s), want) {
+		t.Fatalf("want %v, got %v", want, addrs(s))
+	}
+	if want := "backend.test"; s.Addresses[0].ServerName != want {
+		t.Fatalf("want server name %q, got %q", want, s.Addresses[0].ServerName)
+	}
+
+	mu.Lock()
+	ips = []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}
+	mu.Unlock()
+	builder.Resolver().Refresh()
+
+	s = next()
+	if want := []string{"10.0.0.2:50051", "10.0.0.3:50051"}; !reflect.DeepEqual(addrs(s), want) {
+		t.Fatalf("want %v, got %v", want, addrs(s))
+	}
+
+	// No update after close.
+	r.Close()
+	mu.Lock()
+	ips = []net.IP{net.IPv4(10, 0, 0, 4)}
+	mu.Unlock()
+	builder.Resolver().Refresh()
+	select {
+	case s := <-cc.states:
+		t.Fatalf("expect no update after close, got %v", addrs(s))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBuilderEvict(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ips = []net.IP{net.IPv4(10, 0, 0, 1)}
+	)
+	builder, err := NewBuilder(time.Hour, time.Second, dnscache.WithCacheSize(1), dnscache.WithLookupIPFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ips, nil
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer builder.Resolver().Stop()
+
+	cc := &testClientConn{states: make(chan resolver.State, 10)}
+	target := resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/backend.test:50051"}}
+	r, err := builder.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	next := func() resolver.State {
+		t.Helper()
+		select {
+		case s := <-cc.states:
+			return s
+		case <-time.After(time.Second):
+			t.Fatalf("expect state to be updated")
+			return resolver.State{}
+		}
+	}
+	next()
+
+	// Caching another host evicts the watched host, which must be fetched again.
+	mu.Lock()
+	ips = []net.IP{net.IPv4(10, 0, 0, 2)}
+	mu.Unlock()
+	if _, err := builder.Resolver().Fetch(context.Background(), "other.test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s := next()
+	if want := []string{"10.0.0.2:50051"}; !reflect.DeepEqual(addrs(s), want) {
+		t.Fatalf("want %v, got %v", want, addrs(s))
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	cases := []struct {
+		endpoint   string
+		host, port string
+	}{
+		{"example.com:50051", "example.com", "50051"},
+		{"example.com", "example.com", defaultPort},
+		{"[::1]:50051", "::1", "50051"},
+		{"::1", "::1", defaultPort},
+	}
+
+	for _, tc := range cases {
+		host, port, err := splitHostPort(tc.endpoint)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if host != tc.host || port != tc.port {
+			t.Fatalf("want %s %s, got %s %s", tc.host, tc.port, host, port)
+		}
+	}
+
+	if _, _, err := splitHostPort(""); err == nil {
+		t.Fatalf("expect error")
+	}
+}
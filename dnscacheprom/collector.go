@@ -0,0 +1,84 @@
+// Package dnscacheprom provides a Prometheus collector for go-dnscache.
+package dnscacheprom // import "go.mercari.io/go-dnscache/dnscacheprom"
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	dnscache "go.mercari.io/go-dnscache"
+)
+
+const namespace = "dnscache"
+
+// Collector is a `prometheus.Collector` which exposes the statistics of
+// the given resolver.
+type Collector struct {
+	resolver *dnscache.Resolver
+
+	entries          *prometheus.Desc
+	lookups          *prometheus.Desc
+	lookupErrors     *prometheus.Desc
+	cacheHits        *prometheus.Desc
+	cacheMisses      *prometheus.Desc
+	refreshSuccesses *prometheus.Desc
+	refreshFailures  *prometheus.Desc
+	ipSetChanges     *prometheus.Desc
+	lookupDuration   *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a new Collector of the given resolver.
+// constLabels are attached to all metrics, which are useful to distinguish
+// multiple resolvers.
+func NewCollector(resolver *dnscache.Resolver, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, constLabels)
+	}
+
+	return &Collector{
+		resolver:         resolver,
+		entries:          desc("cache_entries", "Current number of cached hosts."),
+		lookups:          desc("lookups_total", "Total number of DNS lookups."),
+		lookupErrors:     desc("lookup_errors_total", "Total number of failed DNS lookups."),
+		cacheHits:        desc("cache_hits_total", "Total number of fetches served from the cache."),
+		cacheMisses:      desc("cache_misses_total", "Total number of fetches which looked up DNS."),
+		refreshSuccesses: desc("refresh_successes_total", "Total number of hosts successfully refreshed."),
+		refreshFailures:  desc("refresh_failures_total", "Total number of hosts failed to refresh."),
+		ipSetChanges:     desc("ip_set_changes_total", "Total number of lookups which changed the cached IP set of a host."),
+		lookupDuration:   desc("lookup_duration_seconds", "Latency of DNS lookups."),
+	}
+}
+
+// Describe implements `prometheus.Collector`.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.entries
+	ch <- c.lookups
+	ch <- c.lookupErrors
+	ch <- c.cacheHits
+	ch <- c.cacheMisses
+	ch <- c.refreshSuccesses
+	ch <- c.refreshFailures
+	ch <- c.ipSetChanges
+	ch <- c.lookupDuration
+}
+
+// Collect implements `prometheus.Collector`.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.resolver.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(c.lookups, prometheus.CounterValue, float64(stats.Lookups))
+	ch <- prometheus.MustNewConstMetric(c.lookupErrors, prometheus.CounterValue, float64(stats.LookupErrors))
+	ch <- prometheus.MustNewConstMetric(c.cacheHits, prometheus.CounterValue, float64(stats.CacheHits))
+	ch <- prometheus.MustNewConstMetric(c.cacheMisses, prometheus.CounterValue, float64(stats.CacheMisses))
+	ch <- prometheus.MustNewConstMetric(c.refreshSuccesses, prometheus.CounterValue, float64(stats.RefreshSuccesses))
+	ch <- prometheus.MustNewConstMetric(c.refreshFailures, prometheus.CounterValue, float64(stats.RefreshFailures))
+	ch <- prometheus.MustNewConstMetric(c.ipSetChanges, prometheus.CounterValue, float64(stats.IPSetChanges))
+
+	latency := stats.LookupLatency
+	buckets := make(map[float64]uint64, len(latency.Bounds))
+	for i, bound := range latency.Bounds {
+		buckets[bound.Seconds()] = latency.Buckets[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(c.lookupDuration, latency.Count, latency.Sum.Seconds(), buckets)
+}
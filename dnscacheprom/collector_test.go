@@ -0,0 +1,71 @@
+package dnscacheprom
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	dnscache "go.mercari.io/go-dnscache"
+)
+
+func TestCollector(t *testing.T) {
+	resolver, err := dnscache.New(time.Hour, time.Second,
+		dnscache.WithFixedFrequency(),
+		dnscache.WithStaticEntries(map[string][]net.IP{
+			"static.jp": {net.IPv4(10, 0, 0, 1)},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ctx := context.Background()
+	for _, host := range []string{"static.jp", "static.jp", "localhost"} {
+		if _, err := resolver.Fetch(ctx, host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	resolver.Refresh()
+
+	collector := NewCollector(resolver, nil)
+
+	want := `
+# HELP dnscache_cache_entries Current number of cached hosts.
+# TYPE dnscache_cache_entries gauge
+dnscache_cache_entries 2
+# HELP dnscache_cache_hits_total Total number of fetches served from the cache.
+# TYPE dnscache_cache_hits_total counter
+dnscache_cache_hits_total 2
+# HELP dnscache_cache_misses_total Total number of fetches which looked up DNS.
+# TYPE dnscache_cache_misses_total counter
+dnscache_cache_misses_total 1
+# HELP dnscache_lookups_total Total number of DNS lookups.
+# TYPE dnscache_lookups_total counter
+dnscache_lookups_total 2
+# HELP dnscache_refresh_successes_total Total number of hosts successfully refreshed.
+# TYPE dnscache_refresh_successes_total counter
+dnscache_refresh_successes_total 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(want),
+		"dnscache_cache_entries",
+		"dnscache_cache_hits_total",
+		"dnscache_cache_misses_total",
+		"dnscache_lookups_total",
+		"dnscache_refresh_successes_total",
+	); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got, want := testutil.CollectAndCount(collector), 9; got != want {
+		t.Fatalf("want %d metrics, got %d", want, got)
+	}
+
+	if lint, err := testutil.CollectAndLint(collector); err != nil || len(lint) > 0 {
+		t.Fatalf("lint problems: %v, err: %v", lint, err)
+	}
+}
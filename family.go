@@ -0,0 +1,74 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+)
+
+// IPFamily is the family of IP addresses which the resolver caches.
+type IPFamily int
+
+const (
+	// DualStack caches both IPv4 and IPv6 addresses.
+	DualStack IPFamily = iota
+
+	// IPv4Only caches only IPv4 addresses.
+	IPv4Only
+
+	// IPv6Only caches only IPv6 addresses.
+	IPv6Only
+)
+
+// filter returns IPs which belong to the family.
+func (f IPFamily) filter(ips []net.IP) []net.IP {
+	if f == DualStack {
+		return ips
+	}
+
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (f == IPv4Only) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// networkFamily returns the IP family required by the given network.
+func networkFamily(network string) IPFamily {
+	switch network {
+	case "tcp4", "udp4", "ip4":
+		return IPv4Only
+	case "tcp6", "udp6", "ip6":
+		return IPv6Only
+	default:
+		return DualStack
+	}
+}
+
+// FetchNetwork fetches IP list of the given addr like `Fetch` and returns only the IPs
+// of the family required by the given network, e.g. IPv4 addresses for "ip4", "tcp4"
+// or "udp4", like `net.Resolver.LookupIP`. The cache entry keeps the IPs of both families
+// (unless `WithIPFamily` option is set), so the different networks share one lookup.
+// If no IP of the family is cached, it returns `*LookupError`.
+func (r *Resolver) FetchNetwork(ctx context.Context, network, addr string) ([]net.IP, error) {
+	ips, err := r.Fetch(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	ips = networkFamily(network).filter(ips)
+	if len(ips) == 0 {
+		return nil, &LookupError{Host: addr, Err: &net.AddrError{Err: "no suitable address found for network " + network, Addr: addr}}
+	}
+	return ips, nil
+}
+
+// isUnixNetwork reports whether the given network is of Unix domain sockets.
+func isUnixNetwork(network string) bool {
+	switch network {
+	case "unix", "unixgram", "unixpacket":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,151 @@
+package dnscache
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+)
+
+// ExcludePrivate is a predicate for `WithIPFilter` option which excludes the private
+// addresses (RFC 1918 for IPv4 and RFC 4193 for IPv6).
+func ExcludePrivate(ip net.IP) bool {
+	return !ip.IsPrivate()
+}
+
+// ExcludeLoopback is a predicate for `WithIPFilter` option which excludes the loopback
+// addresses.
+func ExcludeLoopback(ip net.IP) bool {
+	return !ip.IsLoopback()
+}
+
+// filterIPs returns the IPs which satisfy all the predicates set by `WithIPFilter` option.
+func (r *Resolver) filterIPs(ips []net.IP) []net.IP {
+	if len(r.ipFilters) == 0 {
+		return ips
+	}
+
+	filtered := make([]net.IP, 0, len(ips))
+next:
+	for _, ip := range ips {
+		for _, keep := range r.ipFilters {
+			if !keep(ip) {
+				continue next
+			}
+		}
+		filtered = append(filtered, ip)
+	}
+	return filtered
+}
+
+// hostPattern matches a host exactly, or its subdomains if it starts with "*.",
+// e.g. "*.internal" matches "db.internal" and "a.db.internal" but not "internal".
+type hostPattern string
+
+// match reports whether the given normalized host matches the pattern.
+func (p hostPattern) match(host string) bool {
+	if suffix, ok := strings.CutPrefix(string(p), "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == string(p)
+}
+
+// hostPatterns returns the normalized patterns of the given hosts, or nil if none is given.
+func hostPatterns(hosts []string) []hostPattern {
+	if len(hosts) == 0 {
+		return nil
+	}
+	patterns := make([]hostPattern, len(hosts))
+	for i, host := range hosts {
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			patterns[i] = hostPattern("*." + NormalizeHost(suffix))
+			continue
+		}
+		patterns[i] = hostPattern(NormalizeHost(host))
+	}
+	return patterns
+}
+
+// matchAny reports whether the given normalized host matches any of the patterns.
+func matchAny(patterns []hostPattern, host string) bool {
+	for _, p := range patterns {
+		if p.match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheable reports whether the given host is cached under `WithHostAllowlist` and
+// `WithHostDenylist` options.
+func (r *Resolver) cacheable(host string) bool {
+	if r.hostAllowlist == nil && len(r.hostDenylist) == 0 {
+		return true
+	}
+	host = NormalizeHost(host)
+	if r.hostAllowlist != nil && !matchAny(r.hostAllowlist, host) {
+		return false
+	}
+	return !matchAny(r.hostDenylist, host)
+}
+
+// sortIPs sorts the given IPs in place by their 16-byte forms, so that the 4-byte and
+// 16-byte forms of an IPv4 address sort the same.
+func sortIPs(ips []net.IP) {
+	slices.SortFunc(ips, func(a, b net.IP) int {
+		return bytes.Compare(a.To16(), b.To16())
+	})
+}
+
+// dedupeIPs returns the given IPs without duplicates, keeping the first-seen order.
+// The IPv4 addresses in the 4-byte and 16-byte forms are the same.
+func dedupeIPs(ips []net.IP) []net.IP {
+	seen := make(map[string]struct{}, len(ips))
+	deduped := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		key := ipKey(ip)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		deduped = append(deduped, ip)
+	}
+	return deduped
+}
+
+// sampleIPs returns n IPs randomly chosen by the resolver's random source from the given
+// IPs. The IPs which are also in prev, the IP list cached before, are chosen first so that
+// the sample stays the same across refreshes as long as possible. The chosen IPs are in
+// the given order.
+func (r *Resolver) sampleIPs(ips, prev []net.IP, n int) []net.IP {
+	prevKeys := make(map[string]struct{}, len(prev))
+	for _, ip := range prev {
+		prevKeys[ipKey(ip)] = struct{}{}
+	}
+
+	chosen := make([]bool, len(ips))
+	left := n
+	for i, ip := range ips {
+		if _, ok := prevKeys[ipKey(ip)]; ok && left > 0 {
+			chosen[i] = true
+			left--
+		}
+	}
+	for _, i := range r.perm(len(ips)) {
+		if left == 0 {
+			break
+		}
+		if !chosen[i] {
+			chosen[i] = true
+			left--
+		}
+	}
+
+	sampled := make([]net.IP, 0, n)
+	for i, ip := range ips {
+		if chosen[i] {
+			sampled = append(sampled, ip)
+		}
+	}
+	return sampled
+}
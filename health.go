@@ -0,0 +1,85 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// runHealthCheck checks the health of the cached IPs on every tick of the given ticker
+// until the resolver is stopped.
+func (r *Resolver) runHealthCheck(ctx context.Context, ticker Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			r.checkHealth(ctx)
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// checkHealth probes all the cached IPs and replaces the set of unhealthy IPs with
+// the IPs which failed the probe.
+func (r *Resolver) checkHealth(ctx context.Context) {
+	ips := make(map[string]net.IP)
+	r.lock.RLock()
+	r.forEachEntry(func(_ string, entry *Entry) {
+		for _, ip := range entry.ips {
+			ips[ipKey(ip)] = ip
+		}
+	})
+	r.lock.RUnlock()
+
+	keys := make([]string, 0, len(ips))
+	for key := range ips {
+		keys = append(keys, key)
+	}
+
+	var (
+		mu        sync.Mutex
+		unhealthy = make(map[string]struct{})
+	)
+	forEachConcurrently(keys, healthCheckConcurrency, func(key string) {
+		probeCtx, cancelF := context.WithTimeout(ctx, r.healthInterval)
+		defer cancelF()
+		if r.healthProbe(probeCtx, ips[key]) {
+			return
+		}
+		r.log().Warn("cached IP failed health check",
+			"ip", ips[key].String(),
+		)
+		mu.Lock()
+		unhealthy[key] = struct{}{}
+		mu.Unlock()
+	})
+	if ctx.Err() != nil {
+		// The results of the aborted probes are not reliable.
+		return
+	}
+	r.unhealthy.Store(&unhealthy)
+}
+
+// healthyIPs returns the IPs which did not fail the last health check. If all the IPs
+// failed, it returns them as they are. The returned slice may be the given one.
+func (r *Resolver) healthyIPs(ips []net.IP) []net.IP {
+	unhealthy := r.unhealthy.Load()
+	if unhealthy == nil || len(*unhealthy) == 0 {
+		return ips
+	}
+
+	healthy := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if _, ok := (*unhealthy)[ipKey(ip)]; !ok {
+			healthy = append(healthy, ip)
+		}
+	}
+	if len(healthy) == 0 {
+		return ips
+	}
+	return healthy
+}
@@ -0,0 +1,134 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(10, 0, 0, 2)}}, 0, nil
+	}
+
+	var down atomic.Bool
+	probe := func(ctx context.Context, ip net.IP) bool {
+		return !(down.Load() && ip.Equal(net.IPv4(10, 0, 0, 1)))
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithHealthCheck(10*time.Second, probe),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "health.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	waitFetch := func(want []net.IP) {
+		t.Helper()
+		var got []net.IP
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			got, err = resolver.Fetch(context.Background(), "health.jp")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		}
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// The unhealthy IP is excluded.
+	down.Store(true)
+	clock.Advance(10 * time.Second)
+	waitFetch([]net.IP{net.IPv4(10, 0, 0, 2)})
+
+	// The IP is reinstated once it passes the probe again.
+	down.Store(false)
+	clock.Advance(10 * time.Second)
+	waitFetch([]net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)})
+}
+
+func TestHealthCheckStop(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	var (
+		started  = make(chan struct{}, 1)
+		canceled = make(chan struct{})
+	)
+	probe := func(ctx context.Context, ip net.IP) bool {
+		started <- struct{}{}
+		<-ctx.Done()
+		close(canceled)
+		return false
+	}
+
+	clock := newFakeClock()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithHealthCheck(10*time.Second, probe),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "health.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	clock.Advance(10 * time.Second)
+	<-started
+
+	resolver.Stop()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("expect the probe in progress to be canceled by Stop")
+	}
+}
+
+func TestHealthCheckAllUnhealthy(t *testing.T) {
+	resolver := &Resolver{
+		cache: mapStore{
+			"health.jp": {ips: []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}},
+		},
+		healthInterval: time.Second,
+		healthProbe: func(ctx context.Context, ip net.IP) bool {
+			return false
+		},
+	}
+	resolver.checkHealth(context.Background())
+
+	if n := len(*resolver.unhealthy.Load()); n != 2 {
+		t.Fatalf("expect 2 unhealthy IPs, got %d", n)
+	}
+	got, err := resolver.Fetch(context.Background(), "health.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect all IPs to be returned, want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,27 @@
+package dnscache
+
+import (
+	"context"
+)
+
+// startQuery waits until the resolver is allowed to send a DNS query by the limits set by
+// `WithMaxConcurrentLookups` and `WithQueryRateLimit` options. It returns the function
+// to call when the query finishes, or the error if the context is done first.
+func (r *Resolver) startQuery(ctx context.Context) (func(), error) {
+	release := func() {}
+	if r.lookupSem != nil {
+		if err := r.lookupSem.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		release = func() {
+			r.lookupSem.Release(1)
+		}
+	}
+	if r.limiter != nil {
+		if err := r.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
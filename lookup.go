@@ -0,0 +1,338 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolvConfPath is the path of the system resolver configuration.
+const resolvConfPath = "/etc/resolv.conf"
+
+// nsswitchPath is the path of the name service switch configuration.
+const nsswitchPath = "/etc/nsswitch.conf"
+
+// hostsPath is the path of the hosts file.
+const hostsPath = "/etc/hosts"
+
+// reloadInterval is how often the system configuration files are checked for changes,
+// which is the same as the Go resolver.
+const reloadInterval = 5 * time.Second
+
+// systemConf is the system configuration used by lookupIP.
+var systemConf = &systemConfig{
+	resolvConfPath: resolvConfPath,
+	nsswitchPath:   nsswitchPath,
+	hostsPath:      hostsPath,
+}
+
+// systemConfig caches the system resolver configuration and the hosts file. They are
+// checked for changes at most every reloadInterval and reloaded if the modification
+// time of any of the files changes.
+type systemConfig struct {
+	resolvConfPath, nsswitchPath, hostsPath string
+
+	mu        sync.Mutex
+	loaded    bool
+	checkedAt time.Time
+	modTimes  [3]time.Time
+
+	// conf is nil if the resolver configuration is not available, or the system
+	// resolver consults other sources than the hosts file and DNS, which
+	// lookupIPWithTTL can not emulate.
+	conf *dns.ClientConfig
+
+	// hosts is the set of the names in the hosts file, lowercased and without
+	// a trailing dot.
+	hosts map[string]struct{}
+}
+
+// clientConfig returns the system resolver configuration to query the nameservers for
+// the given host directly. It returns nil if the configuration is not available, or the
+// host is in the hosts file or the system resolver consults other sources.
+func (c *systemConfig) clientConfig(host string) *dns.ClientConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reload(time.Now())
+	if c.conf == nil {
+		return nil
+	}
+	if _, ok := c.hosts[hostsKey(host)]; ok {
+		return nil
+	}
+	return c.conf
+}
+
+// reload reloads the files if reloadInterval has elapsed since they were checked last
+// and any of them is modified. The caller must hold the lock.
+func (c *systemConfig) reload(now time.Time) {
+	if c.loaded && now.Sub(c.checkedAt) < reloadInterval {
+		return
+	}
+	c.checkedAt = now
+
+	var modTimes [3]time.Time
+	for i, path := range []string{c.resolvConfPath, c.nsswitchPath, c.hostsPath} {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+	if c.loaded && modTimes == c.modTimes {
+		return
+	}
+	c.loaded = true
+	c.modTimes = modTimes
+
+	c.conf = nil
+	if filesThenDNS(c.nsswitchPath) {
+		if conf, err := dns.ClientConfigFromFile(c.resolvConfPath); err == nil && len(conf.Servers) > 0 {
+			c.conf = conf
+		}
+	}
+	c.hosts = readHostsFile(c.hostsPath)
+}
+
+// lookupCNAME lookups the canonical name of the given host. This is used to replace
+// lookup function when test.
+var lookupCNAME = func(ctx context.Context, host string) (string, error) {
+	return net.DefaultResolver.LookupCNAME(ctx, host)
+}
+
+// ipAddrsOf returns the addresses of the given IPs without zones, or nil if the IP
+// list is nil.
+func ipAddrsOf(ips []net.IP) []net.IPAddr {
+	if ips == nil {
+		return nil
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs
+}
+
+// splitZones returns the IPs of the given addresses and their zones keyed by ipKey,
+// since `net.IP` can not hold the zones of the IPv6 addresses, e.g. link-local ones.
+// The zones are nil if no address has a zone.
+func splitZones(addrs []net.IPAddr) ([]net.IP, map[string]string) {
+	if addrs == nil {
+		return nil, nil
+	}
+	var zones map[string]string
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+		if addr.Zone == "" {
+			continue
+		}
+		if zones == nil {
+			zones = make(map[string]string)
+		}
+		zones[ipKey(addr.IP)] = addr.Zone
+	}
+	return ips, zones
+}
+
+// dnsServerResolver returns a `net.Resolver` which sends the queries to the given
+// DNS server (host:port) instead of the nameservers in the system configuration.
+func dnsServerResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// failover calls fn with the given resolvers one by one until it succeeds, and returns
+// the last error if all fail. It does not try the next resolver if the host is not found,
+// since it is the answer, nor if the context is done.
+func failover[T any](ctx context.Context, resolvers []*net.Resolver, fn func(*net.Resolver) (T, error)) (T, error) {
+	var (
+		v   T
+		err error
+	)
+	for _, resolver := range resolvers {
+		v, err = fn(resolver)
+		if err == nil || isNotFound(err) || ctx.Err() != nil {
+			return v, err
+		}
+	}
+	return v, err
+}
+
+// useResolvers makes the resolver lookup by the given resolvers with failover.
+func (r *Resolver) useResolvers(resolvers []*net.Resolver) {
+	r.lookupIPFn = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		addrs, err := failover(ctx, resolvers, func(resolver *net.Resolver) ([]net.IPAddr, error) {
+			return resolver.LookupIPAddr(ctx, host)
+		})
+		return addrs, 0, err
+	}
+	r.lookupSRVFn = func(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+		return failover(ctx, resolvers, func(resolver *net.Resolver) ([]*net.SRV, error) {
+			_, srvs, err := resolver.LookupSRV(ctx, service, proto, name)
+			return srvs, err
+		})
+	}
+	r.lookupCNAMEFn = func(ctx context.Context, host string) (string, error) {
+		return failover(ctx, resolvers, func(resolver *net.Resolver) (string, error) {
+			return resolver.LookupCNAME(ctx, host)
+		})
+	}
+}
+
+// filesThenDNS reports whether the hosts database of the name service switch configuration
+// of the given path consults the hosts file and then DNS only. It is true if the configuration
+// or the hosts database is missing, which the Go resolver treats in the same way.
+func filesThenDNS(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "hosts:" {
+			return slices.Equal(fields[1:], []string{"files", "dns"})
+		}
+	}
+	return true
+}
+
+// readHostsFile returns the set of the names in the hosts file of the given path keyed
+// by hostsKey. It returns nil if the file can not be read.
+func readHostsFile(path string) map[string]struct{} {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	hosts := make(map[string]struct{})
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range fields[1:] {
+			hosts[hostsKey(name)] = struct{}{}
+		}
+	}
+	return hosts
+}
+
+// hostsKey returns the key of the given name in the hosts file, which is matched
+// case-insensitively with or without a trailing dot.
+func hostsKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookupIPWithTTL queries A and AAAA records of the given host to the
+// nameservers in the system resolver configuration. It returns the IP list
+// and the minimum TTL of the answers including the CNAME records leading to them.
+// It returns `*net.DNSError` whose IsNotFound is true only if every name in the
+// search list is answered not to exist. Each query times out by the timeout of the
+// configuration, or the default of `dns.Client` if it is not set.
+func lookupIPWithTTL(ctx context.Context, conf *dns.ClientConfig, host string) ([]net.IP, time.Duration, error) {
+	client := &dns.Client{Timeout: time.Duration(conf.Timeout) * time.Second}
+
+	var lastErr error
+	for _, name := range conf.NameList(host) {
+		var (
+			ips    []net.IP
+			minTTL uint32
+			found  bool
+		)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, qtype)
+
+			in, err := exchange(ctx, client, conf, msg)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			for _, rr := range in.Answer {
+				switch rec := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rec.A)
+				case *dns.AAAA:
+					ips = append(ips, rec.AAAA)
+				case *dns.CNAME:
+					// The addresses are only valid while the chain to them is.
+				default:
+					continue
+				}
+				if ttl := rr.Header().Ttl; !found || ttl < minTTL {
+					minTTL = ttl
+					found = true
+				}
+			}
+		}
+		if len(ips) > 0 {
+			return ips, time.Duration(minTTL) * time.Second, nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, 0, lastErr
+}
+
+// exchange sends the given message to the nameservers one by one and returns
+// the first response which answers the question, including the one that the name
+// does not exist. The truncated response over UDP is retried over TCP. The failures
+// are returned as `*net.DNSError`.
+func exchange(ctx context.Context, client *dns.Client, conf *dns.ClientConfig, msg *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, server := range conf.Servers {
+		addr := net.JoinHostPort(server, conf.Port)
+		in, _, err := client.ExchangeContext(ctx, msg, addr)
+		if err == nil && in.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: client.Timeout}
+			in, _, err = tcp.ExchangeContext(ctx, msg, addr)
+		}
+		if err != nil {
+			// Report the transport failure in the same way as `net.Resolver`, so that
+			// the timeouts are classified by `*net.DNSError`.
+			var ne net.Error
+			lastErr = &net.DNSError{
+				Err:         err.Error(),
+				Name:        msg.Question[0].Name,
+				Server:      addr,
+				IsTimeout:   errors.As(err, &ne) && ne.Timeout(),
+				IsTemporary: true,
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if in.Rcode == dns.RcodeSuccess || in.Rcode == dns.RcodeNameError {
+			return in, nil
+		}
+		// The server failed to answer, e.g. SERVFAIL or REFUSED. Ask the next one.
+		lastErr = &net.DNSError{
+			Err:         "server misbehaving: " + dns.RcodeToString[in.Rcode],
+			Name:        msg.Question[0].Name,
+			Server:      addr,
+			IsTemporary: in.Rcode == dns.RcodeServerFailure,
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,432 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDNSServer starts a fake DNS server on localhost which answers A records
+// of the given hosts with the given TTL. It returns the address of the server.
+func testDNSServer(t *testing.T, records map[string]net.IP, ttl uint32) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		q := req.Question[0]
+		ip, ok := records[q.Name]
+		switch {
+		case !ok:
+			msg.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA:
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ip,
+			})
+		}
+		_ = w.WriteMsg(msg)
+	})
+
+	return serveDNS(t, pc, handler)
+}
+
+// serveDNS serves the given handler over UDP by the given connection and over TCP
+// on the same port. It returns the address of the server.
+func serveDNS(t *testing.T, pc net.PacketConn, handler dns.Handler) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, server := range []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: l, Handler: handler},
+	} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func() {
+			_ = server.ActivateAndServe()
+		}()
+		<-started
+		t.Cleanup(func() {
+			_ = server.Shutdown()
+		})
+	}
+
+	return pc.LocalAddr().String()
+}
+
+// testNetResolver returns a `net.Resolver` which dials the given DNS server.
+func testNetResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", server)
+		},
+	}
+}
+
+func TestLookupIPWithTTL(t *testing.T) {
+	server := testDNSServer(t, map[string]net.IP{
+		"ttl.jp.": net.IPv4(10, 0, 0, 1),
+	}, 30)
+	host, port, _ := net.SplitHostPort(server)
+	conf := &dns.ClientConfig{Servers: []string{host}, Port: port, Ndots: 1}
+
+	ips, ttl, err := lookupIPWithTTL(context.Background(), conf, "ttl.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if want := 30 * time.Second; ttl != want {
+		t.Fatalf("want TTL %v, got %v", want, ttl)
+	}
+
+	if _, _, err := lookupIPWithTTL(context.Background(), conf, "unknown.jp"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
+
+func TestLookupIPWithTTLTimeout(t *testing.T) {
+	// The server never answers.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer pc.Close()
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	conf := &dns.ClientConfig{Servers: []string{host}, Port: port, Ndots: 1}
+
+	ctx, cancelF := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelF()
+	_, _, err = lookupIPWithTTL(ctx, conf, "timeout.jp")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout || dnsErr.IsNotFound {
+		t.Fatalf("expect timeout error, got %#v", err)
+	}
+	if want := pc.LocalAddr().String(); dnsErr.Server != want {
+		t.Fatalf("want server %q, got %q", want, dnsErr.Server)
+	}
+	if !isRetryable(err) {
+		t.Fatalf("expect the timeout to be retryable")
+	}
+}
+
+func TestLookupRetriesExchange(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	// The server drops the first query of A record.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var queries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA && atomic.AddInt32(&queries, 1) == 1 {
+			return
+		}
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		if q.Qtype == dns.TypeA {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			})
+		}
+		_ = w.WriteMsg(msg)
+	})
+	host, port, _ := net.SplitHostPort(serveDNS(t, pc, handler))
+	conf := &dns.ClientConfig{Servers: []string{host}, Port: port, Ndots: 1, Timeout: 1}
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		ips, ttl, err := lookupIPWithTTL(ctx, conf, host)
+		return ipAddrsOf(ips), ttl, err
+	}
+
+	// The lookup timeout covers the retry after the query timeout.
+	resolver, err := New(time.Hour, 5*time.Second, WithLookupRetries(1, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ips, err := resolver.LookupIP(context.Background(), "retry.jp")
+	if err != nil {
+		t.Fatalf("expect the timeout to be retried, got %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if got := atomic.LoadInt32(&queries); got != 2 {
+		t.Fatalf("want 2 queries of A record, got %d", got)
+	}
+}
+
+func TestLookupIPWithTTLResponses(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype != dns.TypeA {
+			_ = w.WriteMsg(msg)
+			return
+		}
+		_, udp := w.RemoteAddr().(*net.UDPAddr)
+		a := func(name, ip string) dns.RR {
+			return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)}
+		}
+		switch q.Name {
+		case "servfail.jp.":
+			msg.Rcode = dns.RcodeServerFailure
+		case "truncated.jp.":
+			// Only the first address fits in UDP.
+			msg.Answer = append(msg.Answer, a(q.Name, "10.0.0.1"))
+			if udp {
+				msg.Truncated = true
+			} else {
+				msg.Answer = append(msg.Answer, a(q.Name, "10.0.0.2"))
+			}
+		case "cname.jp.":
+			msg.Answer = append(msg.Answer,
+				&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 5}, Target: "target.jp."},
+				a("target.jp.", "10.0.0.3"),
+			)
+		default:
+			msg.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(msg)
+	})
+	host, port, _ := net.SplitHostPort(serveDNS(t, pc, handler))
+	conf := &dns.ClientConfig{Servers: []string{host}, Port: port, Ndots: 1}
+	ctx := context.Background()
+
+	// The server failure is not the answer that the host does not exist.
+	_, _, err = lookupIPWithTTL(ctx, conf, "servfail.jp")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Fatalf("expect temporary error, got %#v", err)
+	}
+	if _, _, err := lookupIPWithTTL(ctx, conf, "unknown.jp"); !isNotFound(err) {
+		t.Fatalf("expect not found error, got %v", err)
+	}
+
+	ips, _, err := lookupIPWithTTL(ctx, conf, "truncated.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("expect the full answer over TCP %v, got %v", want, ips)
+	}
+
+	ips, ttl, err := lookupIPWithTTL(ctx, conf, "cname.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 3)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if want := 5 * time.Second; ttl != want {
+		t.Fatalf("expect the TTL of CNAME %v, got %v", want, ttl)
+	}
+}
+
+func TestSystemResolverConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return path
+	}
+
+	cases := []struct {
+		content string
+		want    bool
+	}{
+		{"hosts: files dns\n", true},
+		{"passwd: files\nhosts:   files dns # comment\n", true},
+		{"passwd: files\n", true},
+		{"hosts: files mdns4_minimal [NOTFOUND=return] dns\n", false},
+		{"hosts: dns files\n", false},
+	}
+	for _, tc := range cases {
+		if got := filesThenDNS(write("nsswitch.conf", tc.content)); got != tc.want {
+			t.Errorf("%q: want %v, got %v", tc.content, tc.want, got)
+		}
+	}
+	if !filesThenDNS(filepath.Join(dir, "missing")) {
+		t.Errorf("expect missing configuration to be files then dns")
+	}
+
+	conf := &systemConfig{
+		resolvConfPath: write("resolv.conf", "nameserver 10.0.0.53\n"),
+		nsswitchPath:   write("nsswitch.conf", "hosts: files dns\n"),
+		hostsPath:      write("hosts", "127.0.0.1 localhost\n# 10.0.0.1 commented.jp\n10.0.0.2 Override.jp. alias.jp\n"),
+	}
+	// The hosts in the hosts file are not queried directly.
+	for host, want := range map[string]bool{
+		"localhost":    true,
+		"override.jp":  true,
+		"override.jp.": true,
+		"alias.jp":     true,
+		"commented.jp": false,
+		"other.jp":     false,
+	} {
+		if got := conf.clientConfig(host) == nil; got != want {
+			t.Errorf("%s: want in hosts file %v, got %v", host, want, got)
+		}
+	}
+	if got := conf.clientConfig("other.jp").Servers; !reflect.DeepEqual(got, []string{"10.0.0.53"}) {
+		t.Fatalf("want servers [10.0.0.53], got %v", got)
+	}
+
+	// The files are reloaded after reloadInterval if they are modified.
+	modified := time.Now().Add(time.Hour)
+	for name, content := range map[string]string{
+		"resolv.conf": "nameserver 10.0.0.54\n",
+		"hosts":       "10.0.0.3 other.jp\n",
+	} {
+		path := write(name, content)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if conf.clientConfig("other.jp") == nil {
+		t.Fatalf("expect not to reload before reloadInterval")
+	}
+	conf.checkedAt = conf.checkedAt.Add(-reloadInterval)
+	if conf.clientConfig("other.jp") != nil {
+		t.Fatalf("expect the modified hosts file to be reloaded")
+	}
+	if got := conf.clientConfig("localhost").Servers; !reflect.DeepEqual(got, []string{"10.0.0.54"}) {
+		t.Fatalf("want reloaded servers [10.0.0.54], got %v", got)
+	}
+}
+
+func TestWithResolver(t *testing.T) {
+	server := testDNSServer(t, map[string]net.IP{
+		"internal.jp.": net.IPv4(10, 0, 0, 1),
+	}, 30)
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithResolver(testNetResolver(server)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ips, err := resolver.Fetch(context.Background(), "internal.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+}
+
+func TestWithDNSServer(t *testing.T) {
+	server := testDNSServer(t, map[string]net.IP{
+		"internal.jp.": net.IPv4(10, 0, 0, 1),
+	}, 30)
+
+	// The closed port refuses the queries, so the next server is tried.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	closed := pc.LocalAddr().String()
+	pc.Close()
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithDNSServer(closed, server))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ips, err := resolver.Fetch(context.Background(), "internal.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+
+	_, err = resolver.Fetch(context.Background(), "unknown.jp")
+	if !isNotFound(err) {
+		t.Fatalf("expect not found error, got %v", err)
+	}
+}
+
+func TestWithResolvers(t *testing.T) {
+	server := testDNSServer(t, map[string]net.IP{
+		"internal.jp.": net.IPv4(10, 0, 0, 1),
+	}, 30)
+
+	var primaryCalled atomic.Int32
+	primary := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			primaryCalled.Add(1)
+			return nil, errors.New("primary is down")
+		},
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithResolvers(primary, testNetResolver(server)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ips, err := resolver.Fetch(context.Background(), "internal.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(want, normalizeIPs(ips)) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if primaryCalled.Load() == 0 {
+		t.Fatalf("expect the primary resolver to be tried first")
+	}
+
+	// The secondary is not tried after the context is done.
+	ctx, cancelF := context.WithCancel(context.Background())
+	cancelF()
+	if _, err := resolver.LookupIP(ctx, "internal.jp"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
+
+// normalizeIPs converts the given IPs to 16-byte form to compare.
+func normalizeIPs(ips []net.IP) []net.IP {
+	normalized := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		normalized[i] = ip.To16()
+	}
+	return normalized
+}
@@ -2,27 +2,154 @@ package dnscache
 
 import (
 	"context"
-	"math/rand"
+	"crypto/tls"
+	"errors"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"sync/atomic"
 	"time"
 )
 
+// randPerm returns a random permutation of [0, n) when no source is set by
+// `WithRandSource` option. This is used to replace it when test.
 var randPerm = func(n int) []int {
 	return rand.Perm(n)
 }
 
+// contextWithTimeout is `context.WithTimeout`. This is used to replace it when test.
+var contextWithTimeout = context.WithTimeout
+
+// perm returns a random permutation of [0, n) by the resolver's random source.
+func (r *Resolver) perm(n int) []int {
+	if r.rand == nil {
+		return randPerm(n)
+	}
+	r.randLock.Lock()
+	defer r.randLock.Unlock()
+	return r.rand.Perm(n)
+}
+
+// float64 returns a random number in [0.0, 1.0) by the resolver's random source.
+func (r *Resolver) float64() float64 {
+	if r.rand == nil {
+		return rand.Float64()
+	}
+	r.randLock.Lock()
+	defer r.randLock.Unlock()
+	return r.rand.Float64()
+}
+
+// DialStrategy is the strategy that `DialFunc` uses to decide the order of
+// IPs to dial.
+type DialStrategy int
+
+const (
+	// Random dials IPs in random order.
+	Random DialStrategy = iota
+
+	// RoundRobin rotates the first IP to dial for each host on every dial.
+	RoundRobin
+
+	// Sequential dials IPs in the cached order.
+	Sequential
+
+	// PreferLastSuccessful dials the IP which was dialed successfully last
+	// time for each host first, and then the rest in random order.
+	PreferLastSuccessful
+)
+
+// DialError is an error of dialing an IP of the host.
+type DialError struct {
+	Host string
+	IP   net.IP
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return "dial " + e.Host + " (" + e.IP.String() + "): " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
 type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
 
+// chosenIPKey is the context key of the IP dialed by `DialFunc`.
+type chosenIPKey struct{}
+
+// WithChosenIP returns a copy of the given context in which `DialFunc` records the IP
+// it dialed successfully. Read it by `ChosenIP` with the returned context after dialing.
+//
+// With `http.Transport`, pass the returned context to the request by
+// `http.Request.WithContext`, since the transport dials with the request context.
+// Note that the transport reuses the idle connections without dialing, in which case
+// nothing is recorded. To know the IP of every request, use the `GotConn` hook of
+// `net/http/httptrace` and `RemoteAddr` of the given connection instead.
+func WithChosenIP(ctx context.Context) context.Context {
+	return context.WithValue(ctx, chosenIPKey{}, new(atomic.Pointer[net.IP]))
+}
+
+// ChosenIP returns the IP which `DialFunc` dialed successfully with the context returned
+// by `WithChosenIP`. It reports whether any IP has been dialed.
+func ChosenIP(ctx context.Context) (net.IP, bool) {
+	chosen, ok := ctx.Value(chosenIPKey{}).(*atomic.Pointer[net.IP])
+	if !ok {
+		return nil, false
+	}
+	ip := chosen.Load()
+	if ip == nil {
+		return nil, false
+	}
+	return append(net.IP(nil), (*ip)...), true
+}
+
+// recordChosenIP records the dialed IP in the given context if it is returned by
+// `WithChosenIP`.
+func recordChosenIP(ctx context.Context, ip net.IP) {
+	if chosen, ok := ctx.Value(chosenIPKey{}).(*atomic.Pointer[net.IP]); ok {
+		chosen.Store(&ip)
+	}
+}
+
+// NewHTTPTransport returns a clone of the given base transport (`http.DefaultTransport`
+// if nil) whose `DialContext` dials the IPs cached by the resolver via `DialFunc`. The
+// IPs are dialed by the `DialContext` of the base transport if it is set, and the
+// other settings of the base transport are kept. The TLS handshake still uses the
+// original host for SNI and the certificate verification because the transport only
+// replaces the dial to the host with the dial to its IP.
+func NewHTTPTransport(resolver *Resolver, base *http.Transport) *http.Transport {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	transport.DialContext = DialFunc(resolver, base.DialContext)
+	return transport
+}
+
 // DialFunc is a helper function which returns `net.DialContext` function.
 // It randomly fetches an IP from the DNS cache and dials it by the given dial
-// function. It dials one by one and returns first connected `net.Conn`.
-// If it fails to dial all IPs from cache it returns first error. If no baseDialFunc
-// is given, it sets default dial function.
+// function (the order can be changed by `WithDialStrategy` or `WithIPOrderer`
+// option). It dials one by one and returns first connected `net.Conn`.
+// The network is passed to the dial function as it is. If the network is
+// "tcp4" or "tcp6" (or "udp4", "udp6"), only IPs of the matching family are dialed.
+// If it fails to dial all IPs from cache it returns the joined errors of all attempts,
+// each of which is `*DialError`. If no baseDialFunc is given, it sets default dial function.
+// If no IP is cached for the network, it returns `*net.AddrError` unless `WithDialFallback`
+// option is set. If the context is returned by `WithChosenIP`, the dialed IP is recorded
+// in it. The zones of the cached IPv6 addresses, e.g. link-local ones, are kept in the
+// address passed to the dial function.
+//
+// If the IP list is not in the cache, it lookups DNS with the timeout set by
+// `WithDialLookupTimeout` option. The cache hits do not derive the context with
+// the timeout. Each IP is dialed with the timeout set by `WithDialAttemptTimeout`
+// option.
 //
 // You can use returned dial function for `http.Transport.DialContext`.
 //
-// In this function, it uses functions from `rand` package. To make it really random,
-// you MUST call `rand.Seed` and change the value from the default in your application
+// The random order is decided by the source set by `WithRandSource` option.
+// By default, the automatically seeded source of `math/rand/v2` is used.
 func DialFunc(resolver *Resolver, baseDialFunc dialFunc) dialFunc {
 	if baseDialFunc == nil {
 		// This is same as which `http.DefaultTransport` uses.
@@ -33,32 +160,188 @@ func DialFunc(resolver *Resolver, baseDialFunc dialFunc) dialFunc {
 		}).DialContext
 	}
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Unix domain sockets have nothing to resolve.
+		if isUnixNetwork(network) {
+			return baseDialFunc(ctx, network, addr)
+		}
+
 		h, p, err := net.SplitHostPort(addr)
 		if err != nil {
 			return nil, err
 		}
+		if !resolver.cacheable(h) {
+			return baseDialFunc(ctx, network, addr)
+		}
 
 		// Fetch DNS result from cache.
 		//
-		// ctxLookup is only used for cancelling DNS Lookup.
-		ctxLookup, cancelF := context.WithTimeout(ctx, resolver.lookupTimeout)
-		defer cancelF()
+		// ctxLookup is only used for cancelling DNS Lookup, so it is not created when
+		// the host is cached. If the entry is removed in the meantime, the lookup is
+		// bounded only by ctx.
+		ctxLookup := ctx
+		if resolver.bypassCache(ctx, h) || !resolver.cached(h) {
+			var cancelF context.CancelFunc
+			ctxLookup, cancelF = contextWithTimeout(ctx, resolver.lookupTimeout(h, resolver.dialLookupTimeout))
+			defer cancelF()
+		}
 		ips, err := resolver.Fetch(ctxLookup, h)
 		if err != nil {
 			return nil, err
 		}
 
-		var firstErr error
-		for _, randomIndex := range randPerm(len(ips)) {
-			conn, err := baseDialFunc(ctx, "tcp", net.JoinHostPort(ips[randomIndex].String(), p))
+		ips = networkFamily(network).filter(ips)
+		if len(ips) == 0 {
+			if resolver.dialFallback {
+				return baseDialFunc(ctx, network, addr)
+			}
+			return nil, &net.AddrError{Err: "no suitable address found in DNS cache for network " + network, Addr: h}
+		}
+
+		// The entry is nil for IP literals, which have no zone to keep.
+		entry, _ := resolver.getEntry(NormalizeHost(h))
+		var errs []error
+		for _, ip := range resolver.orderIPs(h, ips) {
+			host := ip.String()
+			if zone := entry.zone(ip); zone != "" {
+				host += "%" + zone
+			}
+			start := resolver.now()
+			dialCtx, cancelDial := resolver.dialAttemptContext(ctx)
+			conn, err := baseDialFunc(dialCtx, network, net.JoinHostPort(host, p))
+			cancelDial()
+			if resolver.dialTraceFn != nil {
+				resolver.dialTraceFn(h, ip, err, resolver.now().Sub(start))
+			}
+			resolver.observeDial(ctx, h, ip, err)
 			if err == nil {
+				resolver.dialSucceeded(h, ip)
+				recordChosenIP(ctx, ip)
+				resolver.log().Debug("dialed cached IP",
+					"addr", addr,
+					"ip", ip.String(),
+				)
 				return conn, nil
 			}
-			if firstErr == nil {
-				firstErr = err
+			errs = append(errs, &DialError{Host: h, IP: ip, Err: err})
+			// The rest of the IPs are not dialed once the dial is cancelled.
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, errors.Join(errs...)
+	}
+}
+
+// dialAttemptContext returns the context of dialing an IP in `DialFunc`, which has the
+// timeout set by `WithDialAttemptTimeout` option if any.
+func (r *Resolver) dialAttemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.dialAttemptTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.dialAttemptTimeout)
+}
+
+// dialOrder returns the order of indexes of the IPs of the given host to dial.
+func (r *Resolver) dialOrder(host string, ips []net.IP) []int {
+	host = NormalizeHost(host)
+	n := len(ips)
+	switch r.dialStrategy {
+	case Sequential:
+		return sequence(0, n)
+	case RoundRobin:
+		r.dialLock.Lock()
+		if r.rrCursors == nil {
+			r.rrCursors = make(map[string]int)
+		}
+		start := r.rrCursors[host] % n
+		r.rrCursors[host] = start + 1
+		r.dialLock.Unlock()
+		return sequence(start, n)
+	case PreferLastSuccessful:
+		order := r.perm(n)
+		r.dialLock.Lock()
+		last, ok := r.lastDialed[host]
+		r.dialLock.Unlock()
+		if !ok {
+			return order
+		}
+		for i, idx := range order {
+			if ips[idx].Equal(last) {
+				// Move the last successful IP to the front.
+				copy(order[1:i+1], order[:i])
+				order[0] = idx
+				return order
 			}
 		}
+		// The last successful IP is no longer in the cache.
+		r.dialLock.Lock()
+		if r.lastDialed[host].Equal(last) {
+			delete(r.lastDialed, host)
+		}
+		r.dialLock.Unlock()
+		return order
+	default:
+		return r.perm(n)
+	}
+}
 
-		return nil, firstErr
+// dialSucceeded records the IP which is dialed successfully for the given host.
+func (r *Resolver) dialSucceeded(host string, ip net.IP) {
+	if r.dialStrategy != PreferLastSuccessful {
+		return
+	}
+	host = NormalizeHost(host)
+	r.dialLock.Lock()
+	if r.lastDialed == nil {
+		r.lastDialed = make(map[string]net.IP)
+	}
+	r.lastDialed[host] = ip
+	r.dialLock.Unlock()
+}
+
+// sequence returns n indexes starting from start and wrapping around n.
+func sequence(start, n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (start + i) % n
+	}
+	return order
+}
+
+// DialTLSFunc is a helper function which returns a dial function of TLS connections.
+// It dials an IP of the host cached by the resolver like `DialFunc` with the given dial
+// function, and then does the TLS handshake with the given config. If `ServerName` of
+// the config is empty, the original host is used for SNI and the certificate verification,
+// not the dialed IP. The config is not modified.
+//
+// You can use returned dial function for `http.Transport.DialTLSContext`.
+func DialTLSFunc(resolver *Resolver, tlsConfig *tls.Config, baseDialFunc dialFunc) dialFunc {
+	dial := DialFunc(resolver, baseDialFunc)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := tlsConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = h
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
 	}
 }
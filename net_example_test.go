@@ -2,7 +2,6 @@ package dnscache
 
 import (
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"time"
 )
@@ -13,7 +12,6 @@ func ExampleDialFunc() {
 
 	// You can create a HTTP client which selects an IP from dnscache
 	// randomly and dials it.
-	rand.Seed(time.Now().UTC().UnixNano()) // You MUST run in once in your application
 	client := http.Client{
 		Transport: &http.Transport{
 			DialContext: DialFunc(resolver, nil),
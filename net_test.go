@@ -1,23 +1,32 @@
 package dnscache
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"math/rand"
+	"log/slog"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestDialFunc(t *testing.T) {
 	resolver := &Resolver{
-		cache: map[string][]net.IP{
-			"deeeet.com": {
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
 				net.IP("127.0.0.1"),
 				net.IP("127.0.0.2"),
 				net.IP("127.0.0.3"),
-			},
+			}},
 		},
 	}
 
@@ -77,18 +86,13 @@ func TestDialFunc(t *testing.T) {
 }
 
 func TestDialFuncRand(t *testing.T) {
-	rand.Seed(time.Now().UTC().UnixNano())
-	defer func() {
-		rand.Seed(1)
-	}()
-
 	resolver := &Resolver{
-		cache: map[string][]net.IP{
-			"deeeet.com": {
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
 				net.IP("127.0.0.1"),
 				net.IP("127.0.0.2"),
 				net.IP("127.0.0.3"),
-			},
+			}},
 		},
 	}
 
@@ -125,8 +129,8 @@ func TestDialFuncError2(t *testing.T) {
 		lookupIP = originalFunc
 	}()
 
-	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
-		return nil, fmt.Errorf("err")
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return nil, 0, fmt.Errorf("err")
 	}
 
 	if _, err := DialFunc(testResolver(t), nil)(context.Background(), "tcp", "tcnksm.io:443"); err == nil {
@@ -136,12 +140,12 @@ func TestDialFuncError2(t *testing.T) {
 
 func TestDialFuncError3(t *testing.T) {
 	resolver := &Resolver{
-		cache: map[string][]net.IP{
-			"tcnksm.io": {
-				net.IP("1.1.1.1"),
-				net.IP("2.2.2.2"),
-				net.IP("3.3.3.3"),
-			},
+		cache: mapStore{
+			"tcnksm.io": {ips: []net.IP{
+				net.IPv4(1, 1, 1, 1),
+				net.IPv4(2, 2, 2, 2),
+				net.IPv4(3, 3, 3, 3),
+			}},
 		},
 	}
 
@@ -155,20 +159,949 @@ func TestDialFuncError3(t *testing.T) {
 
 	want := errors.New("error1")
 	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		if addr == net.JoinHostPort(net.IP("1.1.1.1").String(), "443") {
+		if addr == net.JoinHostPort("1.1.1.1", "443") {
 			return nil, want // first error should be returned
 		}
-		if addr == net.JoinHostPort(net.IP("2.2.2.2").String(), "443") {
+		if addr == net.JoinHostPort("2.2.2.2", "443") {
 			return nil, fmt.Errorf("error2")
 		}
-		if addr == net.JoinHostPort(net.IP("3.3.3.3").String(), "443") {
+		if addr == net.JoinHostPort("3.3.3.3", "443") {
 			return nil, fmt.Errorf("error3")
 		}
 		return nil, nil
 	}
 
 	_, got := DialFunc(resolver, dialF)(context.Background(), "tcp", "tcnksm.io:443")
-	if got != want {
+	if !errors.Is(got, want) {
 		t.Fatalf("got error %v, want %v", got, want)
 	}
+
+	// All errors should be returned with the dialed IP.
+	for _, msg := range []string{
+		"dial tcnksm.io (1.1.1.1): error1",
+		"dial tcnksm.io (2.2.2.2): error2",
+		"dial tcnksm.io (3.3.3.3): error3",
+	} {
+		if !strings.Contains(got.Error(), msg) {
+			t.Fatalf("expect error %q to contain %q", got, msg)
+		}
+	}
+
+	var dialErr *DialError
+	if !errors.As(got, &dialErr) {
+		t.Fatalf("expect error to be DialError")
+	}
+	if dialErr.Host != "tcnksm.io" || dialErr.Err != want {
+		t.Fatalf("got %#v, want first error of tcnksm.io", dialErr)
+	}
+}
+
+func TestDialFuncErrorTimeout(t *testing.T) {
+	resolver := &Resolver{
+		cache: mapStore{
+			"tcnksm.io": {ips: []net.IP{
+				net.IPv4(1, 1, 1, 1),
+			}},
+		},
+	}
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, context.DeadlineExceeded
+	}
+
+	_, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "tcnksm.io:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect timeout error, got %v", err)
+	}
+}
+
+func TestDialFuncLookupTimeout(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	release := make(chan struct{})
+	defer close(release)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		select {
+		case <-release:
+			return []net.IPAddr{{IP: net.IP("127.0.0.1")}}, 0, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	resolver, err := New(testFreq, time.Hour, WithDialLookupTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, nil
+	}
+	start := time.Now()
+	_, err = DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect timeout error, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("expect dial lookup timeout to be used, took %v", took)
+	}
+}
+
+func TestDialFuncLookupTimeoutOnMiss(t *testing.T) {
+	originalFunc, originalWithTimeout := lookupIP, contextWithTimeout
+	defer func() {
+		lookupIP, contextWithTimeout = originalFunc, originalWithTimeout
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IP("127.0.0.1")}}, 0, nil
+	}
+	var created int
+	contextWithTimeout = func(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+		created++
+		return originalWithTimeout(ctx, timeout)
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expect the lookup context to be created only on the cache miss, created %d times", created)
+	}
+}
+
+func TestDialFuncLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	resolver := &Resolver{
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.IPv4(127, 0, 0, 1),
+			}},
+		},
+	}
+	resolver.SetLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, nil
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{"addr=deeeet.com:443", "ip=127.0.0.1"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expect log %q to contain %q", got, want)
+		}
+	}
+}
+
+func TestDialFuncNetwork(t *testing.T) {
+	cases := []struct {
+		network string
+		want    []string
+	}{
+		{
+			network: "tcp",
+			want:    []string{"127.0.0.1:443", "[::1]:443", "127.0.0.2:443"},
+		},
+		{
+			network: "tcp4",
+			want:    []string{"127.0.0.1:443", "127.0.0.2:443"},
+		},
+		{
+			network: "tcp6",
+			want:    []string{"[::1]:443"},
+		},
+	}
+
+	origFunc := randPerm
+	randPerm = func(n int) []int {
+		perm := make([]int, n)
+		for i := range perm {
+			perm[i] = i
+		}
+		return perm
+	}
+	defer func() {
+		randPerm = origFunc
+	}()
+
+	for _, tc := range cases {
+		t.Run(tc.network, func(t *testing.T) {
+			resolver := &Resolver{
+				cache: mapStore{
+					"deeeet.com": {ips: []net.IP{
+						net.ParseIP("127.0.0.1"),
+						net.ParseIP("::1"),
+						net.ParseIP("127.0.0.2"),
+					}},
+				},
+			}
+
+			var got []string
+			dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if network != tc.network {
+					t.Fatalf("got network %q, want %q", network, tc.network)
+				}
+				got = append(got, addr)
+				return nil, fmt.Errorf("err")
+			}
+			if _, err := DialFunc(resolver, dialF)(context.Background(), tc.network, "deeeet.com:443"); err == nil {
+				t.Fatalf("expect to be failed")
+			}
+
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDialFuncDualStack(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}, {IP: net.IPv6loopback}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	var got []string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		got = append(got, network+" "+addr)
+		return nil, nil
+	}
+	for _, network := range []string{"tcp4", "tcp6"} {
+		if _, err := DialFunc(resolver, dialF)(context.Background(), network, "deeeet.com:443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if want := []string{"tcp4 127.0.0.1:443", "tcp6 [::1]:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	ips, err := resolver.FetchNetwork(context.Background(), "ip6", "deeeet.com")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv6loopback}; !reflect.DeepEqual(ips, want) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect both families to be served by one lookup, called %d times", cnt)
+	}
+}
+
+func TestDialFuncNetworkNoAddress(t *testing.T) {
+	resolver := &Resolver{
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.ParseIP("127.0.0.1"),
+			}},
+		},
+	}
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t.Fatalf("expect not to be dialed")
+		return nil, nil
+	}
+	_, err := DialFunc(resolver, dialF)(context.Background(), "tcp6", "deeeet.com:443")
+	var addrErr *net.AddrError
+	if !errors.As(err, &addrErr) || addrErr.Addr != "deeeet.com" {
+		t.Fatalf("expect address error of the host, got %v", err)
+	}
+}
+
+func TestDialFuncFallback(t *testing.T) {
+	resolver := &Resolver{
+		dialFallback: true,
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{}},
+		},
+	}
+
+	var got []string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		got = append(got, network+" "+addr)
+		return nil, nil
+	}
+	for _, network := range []string{"tcp", "tcp6"} {
+		if _, err := DialFunc(resolver, dialF)(context.Background(), network, "deeeet.com:443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	want := []string{"tcp deeeet.com:443", "tcp6 deeeet.com:443"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestDialFuncAttemptTimeout(t *testing.T) {
+	resolver := &Resolver{
+		dialStrategy:       Sequential,
+		dialAttemptTimeout: 10 * time.Millisecond,
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.IPv4(1, 1, 1, 1),
+				net.IPv4(2, 2, 2, 2),
+			}},
+		},
+	}
+
+	// The first IP hangs until the attempt is given up.
+	var got []string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		got = append(got, addr)
+		if addr == "1.1.1.1:443" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, nil
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []string{"1.1.1.1:443", "2.2.2.2:443"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// The cancellation of the parent context aborts the rest.
+	resolver.dialAttemptTimeout = time.Hour
+	got = nil
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelF()
+	dialF = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		got = append(got, addr)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err := DialFunc(resolver, dialF)(ctx, "tcp", "deeeet.com:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect timeout error, got %v", err)
+	}
+	if want := []string{"1.1.1.1:443"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestDialFuncZone(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.ParseIP("fe80::1"), Zone: "eth0"}}, 0, nil
+	}
+
+	cases := []struct {
+		name    string
+		options []Option
+	}{
+		{"default", nil},
+		// The zones must survive the serialization of the entries.
+		{"store", []Option{WithStore(newFakeStore())}},
+		{"lookup func", []Option{WithLookupIPAddrFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("fe80::1"), Zone: "eth0"}}, nil
+		})}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver, err := New(time.Hour, testDefaultLookupTimeout, tc.options...)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer resolver.Stop()
+
+			var got string
+			dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				got = addr
+				return nil, nil
+			}
+			if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "link-local.jp:443"); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if want := "[fe80::1%eth0]:443"; got != want {
+				t.Fatalf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestDialFuncStrategy(t *testing.T) {
+	cases := []struct {
+		name     string
+		strategy DialStrategy
+		want     []string
+	}{
+		{
+			name:     "RoundRobin",
+			strategy: RoundRobin,
+			want:     []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.1", "127.0.0.2"},
+		},
+		{
+			name:     "Sequential",
+			strategy: Sequential,
+			want:     []string{"127.0.0.1", "127.0.0.1", "127.0.0.1", "127.0.0.1", "127.0.0.1"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := &Resolver{
+				dialStrategy: tc.strategy,
+				cache: mapStore{
+					"deeeet.com": {ips: []net.IP{
+						net.ParseIP("127.0.0.1"),
+						net.ParseIP("127.0.0.2"),
+						net.ParseIP("127.0.0.3"),
+					}},
+				},
+			}
+
+			var got []string
+			dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				h, _, _ := net.SplitHostPort(addr)
+				got = append(got, h)
+				return nil, nil
+			}
+			for range tc.want {
+				if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDialFuncRoundRobinFallthrough(t *testing.T) {
+	resolver := &Resolver{
+		dialStrategy: RoundRobin,
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.ParseIP("127.0.0.1"),
+				net.ParseIP("127.0.0.2"),
+				net.ParseIP("127.0.0.3"),
+			}},
+		},
+	}
+
+	// Skip the first IP so that the second dial starts from 127.0.0.2.
+	resolver.dialOrder("deeeet.com", getEntry(resolver, "deeeet.com").ips)
+
+	var got []string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, _, _ := net.SplitHostPort(addr)
+		got = append(got, h)
+		return nil, fmt.Errorf("err")
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	want := []string{"127.0.0.2", "127.0.0.3", "127.0.0.1"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestDialFuncPreferLastSuccessful(t *testing.T) {
+	resolver := &Resolver{
+		dialStrategy: PreferLastSuccessful,
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.ParseIP("127.0.0.1"),
+				net.ParseIP("127.0.0.2"),
+				net.ParseIP("127.0.0.3"),
+			}},
+		},
+	}
+
+	origFunc := randPerm
+	randPerm = func(n int) []int {
+		return sequence(0, n)
+	}
+	defer func() {
+		randPerm = origFunc
+	}()
+
+	down := map[string]bool{"127.0.0.1": true}
+	var got []string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, _, _ := net.SplitHostPort(addr)
+		got = append(got, h)
+		if down[h] {
+			return nil, fmt.Errorf("err")
+		}
+		return nil, nil
+	}
+	dial := func() {
+		t.Helper()
+		got = nil
+		if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// 127.0.0.1 fails and falls through to 127.0.0.2.
+	dial()
+	if want := []string{"127.0.0.1", "127.0.0.2"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// 127.0.0.2 is preferred even if 127.0.0.1 is back.
+	down = map[string]bool{}
+	dial()
+	if want := []string{"127.0.0.2"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// The preferred IP fails, then falls through to the rest.
+	down = map[string]bool{"127.0.0.2": true}
+	dial()
+	if want := []string{"127.0.0.2", "127.0.0.1"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// The preferred IP disappears from the cache.
+	getEntry(resolver, "deeeet.com").ips = []net.IP{net.ParseIP("127.0.0.3"), net.ParseIP("127.0.0.2")}
+	down = map[string]bool{}
+	dial()
+	if want := []string{"127.0.0.3"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestDialStateForgotten(t *testing.T) {
+	for _, strategy := range []DialStrategy{RoundRobin, PreferLastSuccessful} {
+		resolver := &Resolver{
+			dialStrategy: strategy,
+			cache: mapStore{
+				"a.jp": {ips: []net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)}},
+				"b.jp": {ips: []net.IP{net.IPv4(3, 3, 3, 3)}},
+			},
+		}
+		dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, nil
+		}
+		for _, host := range []string{"a.jp", "b.jp"} {
+			if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", host+":443"); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		if n := len(resolver.rrCursors) + len(resolver.lastDialed); n != 2 {
+			t.Fatalf("%v: expect the state of 2 hosts, got %d", strategy, n)
+		}
+
+		resolver.Remove("a.jp")
+		if _, ok := resolver.rrCursors["a.jp"]; ok {
+			t.Fatalf("%v: expect the cursor of the removed host to be forgotten", strategy)
+		}
+		if _, ok := resolver.lastDialed["a.jp"]; ok {
+			t.Fatalf("%v: expect the last dialed IP of the removed host to be forgotten", strategy)
+		}
+
+		resolver.Clear()
+		if resolver.rrCursors != nil || resolver.lastDialed != nil {
+			t.Fatalf("%v: expect the dial state to be reset", strategy)
+		}
+	}
+}
+
+func TestDialFuncIPLiteral(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		t.Fatalf("expect lookup not to be called for %s", host)
+		return nil, 0, nil
+	}
+
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	var got string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		got = addr
+		return nil, nil
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "[::1]:443"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := "[::1]:443"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestNewHTTPTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.Host)
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resolver, err := New(testFreq, testDefaultLookupTimeout, WithStaticEntries(map[string][]net.IP{
+		"backend.test": {net.IPv4(127, 0, 0, 1)},
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	var dialed []string
+	base := &http.Transport{
+		MaxIdleConnsPerHost: 7,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	transport := NewHTTPTransport(resolver, base)
+	defer transport.CloseIdleConnections()
+	if transport.MaxIdleConnsPerHost != 7 {
+		t.Fatalf("expect base settings to be kept, got %d", transport.MaxIdleConnsPerHost)
+	}
+
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://backend.test:" + port + "/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer res.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := "backend.test:" + port; buf.String() != want {
+		t.Fatalf("want host %q, got %q", want, buf.String())
+	}
+	if want := []string{"127.0.0.1:" + port}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("expect the IP to be dialed by the base dialer, want %v, got %v", want, dialed)
+	}
+}
+
+func TestDialTLSFunc(t *testing.T) {
+	serverNames := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The certificate of the test server is valid for example.com.
+	resolver, err := New(testFreq, testDefaultLookupTimeout, WithStaticEntries(map[string][]net.IP{
+		"example.com": {net.IPv4(127, 0, 0, 1)},
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	conn, err := DialTLSFunc(resolver, &tls.Config{RootCAs: roots}, nil)(context.Background(), "tcp", "example.com:"+port)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	if got := <-serverNames; got != "example.com" {
+		t.Fatalf("want SNI example.com, got %q", got)
+	}
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expect cached IP to be dialed, got %v", got)
+	}
+}
+
+func TestDialFuncUnix(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		t.Fatalf("expect no lookup for unix network: %s", host)
+		return nil, 0, nil
+	}
+
+	resolver, err := New(testFreq, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	var dialed string
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = network + " " + addr
+		return nil, nil
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "unix", "/var/run/app.sock"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := "unix /var/run/app.sock"; dialed != want {
+		t.Fatalf("want %q, got %q", want, dialed)
+	}
+	if resolver.Len() != 0 {
+		t.Fatalf("expect nothing to be cached, got %d entries", resolver.Len())
+	}
+}
+
+func TestDialFuncRandSource(t *testing.T) {
+	dialOrder := func() []string {
+		resolver, err := New(testFreq, testDefaultLookupTimeout,
+			WithRandSource(rand.NewPCG(1, 2)),
+			WithStaticEntries(map[string][]net.IP{
+				"deeeet.com": {
+					net.IPv4(127, 0, 0, 1),
+					net.IPv4(127, 0, 0, 2),
+					net.IPv4(127, 0, 0, 3),
+					net.IPv4(127, 0, 0, 4),
+				},
+			}),
+		)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer resolver.Stop()
+
+		var dialed []string
+		dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, errors.New("err")
+		}
+		for i := 0; i < 5; i++ {
+			_, _ = DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443")
+		}
+		return dialed
+	}
+
+	want := dialOrder()
+	if got := dialOrder(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect the same dial order with the same source, want %v, got %v", want, got)
+	}
+}
+
+func TestDialFuncRandWithoutSeed(t *testing.T) {
+	// Each resolver dials in a random order without seeding anything.
+	firstDialed := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		resolver, err := New(testFreq, testDefaultLookupTimeout,
+			WithStaticEntries(map[string][]net.IP{
+				"deeeet.com": {
+					net.IPv4(127, 0, 0, 1),
+					net.IPv4(127, 0, 0, 2),
+					net.IPv4(127, 0, 0, 3),
+					net.IPv4(127, 0, 0, 4),
+				},
+			}),
+		)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			firstDialed[addr] = true
+			return nil, nil
+		}
+		if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		resolver.Stop()
+	}
+
+	if len(firstDialed) < 2 {
+		t.Fatalf("expect the dial order to vary, always dialed %v first", firstDialed)
+	}
+}
+
+func TestChosenIP(t *testing.T) {
+	resolver := &Resolver{
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.ParseIP("127.0.0.1"),
+				net.ParseIP("127.0.0.2"),
+			}},
+		},
+		dialStrategy: Sequential,
+	}
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if h, _, _ := net.SplitHostPort(addr); h == "127.0.0.1" {
+			return nil, errors.New("err")
+		}
+		return nil, nil
+	}
+
+	if _, ok := ChosenIP(context.Background()); ok {
+		t.Fatalf("expect no IP to be recorded without WithChosenIP")
+	}
+
+	ctx := WithChosenIP(context.Background())
+	if _, ok := ChosenIP(ctx); ok {
+		t.Fatalf("expect no IP to be recorded before dialing")
+	}
+	if _, err := DialFunc(resolver, dialF)(ctx, "tcp", "deeeet.com:443"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ip, ok := ChosenIP(ctx)
+	if !ok || !ip.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("want chosen IP 127.0.0.2, got %v", ip)
+	}
+}
+
+// reverseOrderer is an IPOrderer which dials the IPs in reverse order.
+type reverseOrderer struct{}
+
+func (reverseOrderer) Order(_ string, ips []net.IP) []net.IP {
+	ordered := make([]net.IP, 0, len(ips))
+	for i := len(ips) - 1; i >= 0; i-- {
+		ordered = append(ordered, ips[i])
+	}
+	return ordered
+}
+
+func TestDialFuncIPOrderer(t *testing.T) {
+	cache := mapStore{
+		"deeeet.com": {ips: []net.IP{
+			net.ParseIP("127.0.0.1"),
+			net.ParseIP("127.0.0.2"),
+			net.ParseIP("127.0.0.3"),
+		}},
+	}
+
+	origFunc := randPerm
+	randPerm = func(n int) []int {
+		return []int{1, 2, 0}
+	}
+	defer func() {
+		randPerm = origFunc
+	}()
+
+	cases := []struct {
+		orderer IPOrderer
+		want    []string
+	}{
+		{
+			orderer: reverseOrderer{},
+			want:    []string{"127.0.0.3", "127.0.0.2", "127.0.0.1"},
+		},
+		{
+			orderer: RandomOrderer{},
+			want:    []string{"127.0.0.2", "127.0.0.3", "127.0.0.1"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%T", tc.orderer), func(t *testing.T) {
+			resolver := &Resolver{
+				cache: cache,
+				// The orderer takes precedence over the strategy.
+				dialStrategy: Sequential,
+				ipOrderer:    tc.orderer,
+			}
+
+			var got []string
+			dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				h, _, _ := net.SplitHostPort(addr)
+				got = append(got, h)
+				return nil, errors.New("err")
+			}
+			if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err == nil {
+				t.Fatalf("expect to be failed")
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDialTrace(t *testing.T) {
+	type attempt struct {
+		host string
+		ip   string
+		err  bool
+	}
+	var got []attempt
+	resolver := &Resolver{
+		dialStrategy: Sequential,
+		dialTraceFn: func(host string, ip net.IP, err error, took time.Duration) {
+			if took < 0 {
+				t.Errorf("expect non-negative duration, got %v", took)
+			}
+			got = append(got, attempt{host, ip.String(), err != nil})
+		},
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.IPv4(127, 0, 0, 1),
+				net.IPv4(127, 0, 0, 2),
+				net.IPv4(127, 0, 0, 3),
+			}},
+		},
+	}
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != "127.0.0.2:443" {
+			return nil, errors.New("refused")
+		}
+		return nil, nil
+	}
+	if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	want := []attempt{
+		{"deeeet.com", "127.0.0.1", true},
+		{"deeeet.com", "127.0.0.2", false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
 }
@@ -1,13 +1,600 @@
 package dnscache
 
-import "log/slog"
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
 
 type Option struct {
 	apply func(r *Resolver)
 }
 
+// WithLogger sets the `log/slog` logger of the resolver. The resolver logs through it
+// directly, so any `slog.Handler` can receive the records without an adapter. Default
+// (or if nil) is `slog.Default()`. Use `SetLogger` to replace it at runtime.
 func WithLogger(logger *slog.Logger) Option {
 	return Option{apply: func(r *Resolver) {
-		r.logger = logger
+		r.logger.Store(logger)
+	}}
+}
+
+// WithFixedFrequency makes the resolver refresh all cached entries every
+// refresh frequency regardless of the TTL of the DNS records.
+func WithFixedFrequency() Option {
+	return Option{apply: func(r *Resolver) {
+		r.fixedFreq = true
+	}}
+}
+
+// WithStaticEntries sets the fixed IP list for the given hosts like a hosts file.
+// These entries are returned without DNS lookup and never refreshed. The IP lists are
+// copied, so the given map may be modified afterwards.
+func WithStaticEntries(entries map[string][]net.IP) Option {
+	return Option{apply: func(r *Resolver) {
+		for addr, ips := range entries {
+			r.cache.Set(NormalizeHost(addr), &Entry{ips: copyIPs(ips), static: true})
+		}
+	}}
+}
+
+// WithDialLookupTimeout sets the timeout of DNS lookup in `DialFunc`.
+// By default, lookupTimeout given to `New` is used.
+func WithDialLookupTimeout(timeout time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		if timeout > 0 {
+			r.dialLookupTimeout = timeout
+		}
+	}}
+}
+
+// WithOnRefreshed sets the function which is called every time the resolver
+// refreshes the cache in the background.
+func WithOnRefreshed(fn func()) Option {
+	return Option{apply: func(r *Resolver) {
+		if fn != nil {
+			r.onRefreshedFn = fn
+		}
+	}}
+}
+
+// WithIPFamily makes the resolver cache only the IP addresses of the given family.
+// If no address of the family is found, the lookup fails. Default is `DualStack`.
+func WithIPFamily(family IPFamily) Option {
+	return Option{apply: func(r *Resolver) {
+		r.family = family
+	}}
+}
+
+// WithDialStrategy sets the strategy that `DialFunc` uses to decide the order
+// of IPs to dial. Default is `Random`.
+func WithDialStrategy(strategy DialStrategy) Option {
+	return Option{apply: func(r *Resolver) {
+		r.dialStrategy = strategy
+	}}
+}
+
+// WithQueryRateLimit limits the DNS queries of the resolver, including the lookups by `Fetch`
+// and refreshing, to the given number per second, e.g. not to overwhelm the DNS servers
+// after the cache is cleared. The queries are evenly spaced. The lookup waits for its turn
+// until the context is done. Default is no limit.
+func WithQueryRateLimit(qps int) Option {
+	return Option{apply: func(r *Resolver) {
+		if qps > 0 {
+			r.limiter = rate.NewLimiter(rate.Limit(qps), 1)
+		}
+	}}
+}
+
+// WithMaxConcurrentLookups limits the number of DNS queries of the resolver in flight at the
+// same time to n, across the lookups by `Fetch` and refreshing, e.g. to protect a shared DNS
+// server. Unlike `WithRefreshConcurrency` option, it also limits the lookups by `Fetch`.
+// The lookup waits for a slot until the context is done. Default is no limit.
+func WithMaxConcurrentLookups(n int) Option {
+	return Option{apply: func(r *Resolver) {
+		if n > 0 {
+			r.lookupSem = semaphore.NewWeighted(int64(n))
+		}
+	}}
+}
+
+// WithStableSort makes the resolver sort the IPs of each host by their bytes before caching
+// them, so that the cached order does not depend on the order of the DNS answers, e.g. for
+// golden tests. `DialFunc` still dials them in the order of the dial strategy, so combine it
+// with the `Sequential` strategy to dial them in the sorted order.
+func WithStableSort(enabled bool) Option {
+	return Option{apply: func(r *Resolver) {
+		r.stableSort = enabled
+	}}
+}
+
+// WithBackgroundRefresh makes `Fetch` of the entry whose TTL has elapsed return the cached
+// IP list immediately and refresh it in background, instead of waiting for the next refresh.
+// The entry whose TTL is unknown is refreshed if it was looked up longer ago than the refresh
+// frequency. Only one background refresh runs for each host at the same time. `Fetch` still
+// waits for the lookup of the host which is not in the cache.
+func WithBackgroundRefresh(enabled bool) Option {
+	return Option{apply: func(r *Resolver) {
+		r.backgroundRefresh = enabled
+	}}
+}
+
+// WithHealthCheck makes the resolver probe all the cached IPs by the given function every
+// interval in background. The probe should report whether the IP is healthy, e.g. by
+// dialing it, within the given context, which is cancelled after the interval. The IPs
+// which failed the last probe are excluded from the results of `Fetch` (and so `DialFunc`)
+// until they pass the probe again. If all the IPs of a host are unhealthy, they are
+// returned as they are.
+func WithHealthCheck(interval time.Duration, probe func(ctx context.Context, ip net.IP) bool) Option {
+	return Option{apply: func(r *Resolver) {
+		if interval <= 0 || probe == nil {
+			return
+		}
+		r.healthInterval = interval
+		r.healthProbe = probe
+	}}
+}
+
+// WithIPOrderer sets the orderer that `DialFunc` uses to decide the order of IPs to dial.
+// It takes precedence over `WithDialStrategy` option. By default, the dial strategy is used.
+func WithIPOrderer(orderer IPOrderer) Option {
+	return Option{apply: func(r *Resolver) {
+		r.ipOrderer = orderer
+	}}
+}
+
+// WithDialTrace sets the function called after every attempt of `DialFunc` to dial an IP,
+// e.g. to record the latency of each IP. It receives the dialed host (without port), the IP,
+// the error of the dial (nil if it succeeded) and how long the dial took. It is called
+// in the order of the attempts, blocking the next attempt, so it should return quickly.
+func WithDialTrace(fn func(host string, ip net.IP, err error, took time.Duration)) Option {
+	return Option{apply: func(r *Resolver) {
+		r.dialTraceFn = fn
+	}}
+}
+
+// WithDialFallback makes `DialFunc` dial the original host:port by the base dial
+// function when the cache has no IP to dial for the network, e.g. an IPv4-only host
+// dialed on "tcp6", instead of returning an error. Then the base dial function
+// resolves the host by itself.
+func WithDialFallback() Option {
+	return Option{apply: func(r *Resolver) {
+		r.dialFallback = true
+	}}
+}
+
+// WithDialAttemptTimeout sets the timeout of dialing each IP in `DialFunc`. When it
+// elapses, `DialFunc` gives up the IP and dials the next one, so that a single unresponsive
+// IP does not consume the whole deadline of the request. The cancellation of the context
+// given to the dial function still aborts all the attempts. By default, each attempt is
+// only bounded by the base dial function's own timeout.
+func WithDialAttemptTimeout(timeout time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		if timeout > 0 {
+			r.dialAttemptTimeout = timeout
+		}
+	}}
+}
+
+// WithNegativeTTL makes the resolver cache the lookup failures for the given duration.
+// While the failure is cached, `Fetch` returns the cached error without DNS lookup.
+// Only the failures caused by non-existent hosts (NXDOMAIN) are cached, and
+// transient failures like timeouts are not.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		r.negativeTTL = ttl
+	}}
+}
+
+// WithStaleWhileRevalidate sets how long the resolver keeps serving the previous IP list
+// of a host which fails to refresh. The entry is dropped from the cache once it has not
+// been refreshed successfully for longer than maxStale. By default, it is kept forever.
+// Use `WithOnStaleEvict` option to be notified of the dropped entries.
+func WithStaleWhileRevalidate(maxStale time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		r.maxStale = maxStale
+	}}
+}
+
+// WithMaxStaleAge is the same as `WithStaleWhileRevalidate`. The entry which has not been
+// refreshed successfully for longer than maxAge is dropped from the cache. Every successful
+// refresh resets the age.
+func WithMaxStaleAge(maxAge time.Duration) Option {
+	return WithStaleWhileRevalidate(maxAge)
+}
+
+// WithOnStaleEvict sets the function called when the entry which has not been refreshed
+// successfully for longer than the max stale age set by `WithStaleWhileRevalidate` or
+// `WithMaxStaleAge` option is dropped from the cache, e.g. to close the connections to
+// the host. It is called once per dropped entry without holding the lock.
+func WithOnStaleEvict(fn func(host string)) Option {
+	return Option{apply: func(r *Resolver) {
+		r.onStaleEvictFn = fn
+	}}
+}
+
+// WithLookupIPFunc sets the function to lookup IP list of a host, e.g. to use DNS over HTTPS
+// or a custom `net.Resolver`. Since the function does not report the TTL, the entries
+// looked up by it are refreshed every refresh frequency. By default, the system resolver is used.
+func WithLookupIPFunc(fn func(ctx context.Context, host string) ([]net.IP, error)) Option {
+	return Option{apply: func(r *Resolver) {
+		if fn == nil {
+			return
+		}
+		r.lookupIPFn = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+			ips, err := fn(ctx, host)
+			return ipAddrsOf(ips), 0, err
+		}
+	}}
+}
+
+// WithLookupIPAddrFunc is like `WithLookupIPFunc` but the function returns the addresses
+// with their zones, e.g. `net.Resolver.LookupIPAddr`. The zones of the IPv6 link-local
+// addresses are kept in the cache and used by `DialFunc`.
+func WithLookupIPAddrFunc(fn func(ctx context.Context, host string) ([]net.IPAddr, error)) Option {
+	return Option{apply: func(r *Resolver) {
+		if fn == nil {
+			return
+		}
+		r.lookupIPFn = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+			addrs, err := fn(ctx, host)
+			return addrs, 0, err
+		}
+	}}
+}
+
+// WithResolver makes the resolver lookup IP list by the given `net.Resolver`,
+// e.g. which dials an internal DNS server. Since `net.Resolver` does not report the TTL,
+// the entries are refreshed every refresh frequency. SRV records and canonical names
+// are also looked up by it.
+func WithResolver(resolver *net.Resolver) Option {
+	return Option{apply: func(r *Resolver) {
+		if resolver == nil {
+			return
+		}
+		r.useResolvers([]*net.Resolver{resolver})
+	}}
+}
+
+// WithResolvers is like `WithResolver` but takes multiple resolvers, e.g. of the primary
+// and the secondary DNS servers. They are tried in order until one answers, and the last
+// error is returned if all fail. The resolvers share the lookup timeout, so the rest are
+// not tried once it elapses. A not found error is returned without trying the rest.
+func WithResolvers(resolvers ...*net.Resolver) Option {
+	return Option{apply: func(r *Resolver) {
+		var nonNil []*net.Resolver
+		for _, resolver := range resolvers {
+			if resolver != nil {
+				nonNil = append(nonNil, resolver)
+			}
+		}
+		if len(nonNil) == 0 {
+			return
+		}
+		r.useResolvers(nonNil)
+	}}
+}
+
+// WithDNSServer makes the resolver lookup IP list, SRV records and canonical names by
+// the given DNS servers (host:port, e.g. "10.0.0.53:53") instead of the nameservers in
+// the system configuration. If multiple servers are given, they are tried in order until
+// one answers. Like `WithResolver`, the entries are refreshed every refresh frequency.
+func WithDNSServer(servers ...string) Option {
+	return Option{apply: func(r *Resolver) {
+		if len(servers) == 0 {
+			return
+		}
+		resolvers := make([]*net.Resolver, len(servers))
+		for i, server := range servers {
+			resolvers[i] = dnsServerResolver(server)
+		}
+		r.useResolvers(resolvers)
+	}}
+}
+
+// WithRefreshConcurrency sets the number of hosts which are refreshed concurrently.
+// Each lookup has its own timeout. Default is 1, which refreshes hosts one by one.
+func WithRefreshConcurrency(n int) Option {
+	return Option{apply: func(r *Resolver) {
+		if n > 0 {
+			r.refreshConcurrency = n
+		}
+	}}
+}
+
+// WithRefreshJitter randomizes each refresh interval by up to ±fraction of the refresh
+// frequency, e.g. 0.1 for ±10%. This avoids that many instances refresh at the same time.
+func WithRefreshJitter(fraction float64) Option {
+	return Option{apply: func(r *Resolver) {
+		if fraction > 0 && fraction < 1 {
+			r.refreshJitter = fraction
+		}
+	}}
+}
+
+// WithExpiryScheduler makes the resolver refresh each host when its TTL elapses, by one
+// timer set to the earliest deadline of the hosts, instead of checking the hosts on every
+// tick of the refresh frequency. The hosts with short TTLs are refreshed on time, and
+// the hosts with long TTLs are not visited until they are due. The hosts whose TTL is
+// unknown are refreshed every refresh frequency, and the failed refreshes are retried
+// after it. The negative cache, the idle hosts and SRV records are still handled on
+// the ticks of the refresh frequency.
+func WithExpiryScheduler() Option {
+	return Option{apply: func(r *Resolver) {
+		r.sched = newScheduler()
+	}}
+}
+
+// WithInitialDelay delays the first refresh by d, i.e. the first refresh happens d after
+// the first refresh interval. The following refreshes happen every refresh interval after
+// it as usual. The hosts which are not cached are looked up on `Fetch` during the delay.
+// Pass a random duration, e.g. `rand.N(freq)`, to spread the refreshes of many instances
+// started at the same time.
+func WithInitialDelay(d time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		if d > 0 {
+			r.initialDelay = d
+		}
+	}}
+}
+
+// WithInitialHosts sets the hosts which are looked up concurrently when the resolver
+// starts. Failures are logged and do not fail `New`. Use `Ready` or `WithBlockingWarmup`
+// option to wait until they are cached.
+func WithInitialHosts(hosts []string) Option {
+	return Option{apply: func(r *Resolver) {
+		r.initialHosts = append(r.initialHosts, hosts...)
+	}}
+}
+
+// WithBlockingWarmup makes `New` wait until the initial hosts given by
+// `WithInitialHosts` option are looked up.
+func WithBlockingWarmup() Option {
+	return Option{apply: func(r *Resolver) {
+		r.blockingWarmup = true
+	}}
+}
+
+// WithClock sets the clock which the resolver uses for refreshing and TTL.
+// This is mainly used to control time in tests.
+func WithClock(clock Clock) Option {
+	return Option{apply: func(r *Resolver) {
+		r.clock = clock
+	}}
+}
+
+// WithRemoveFailedHosts makes the resolver remove a host from the cache when refreshing
+// it fails threshold times in a row. A successful lookup resets the count. A threshold
+// of 1 removes the host on the first failure. By default, failed hosts are kept.
+// Only the errors which mean the host does not exist (NXDOMAIN) count, and transient
+// errors like timeouts do not. Use `WithEvictOnErrors` to change it.
+func WithRemoveFailedHosts(threshold int) Option {
+	return Option{apply: func(r *Resolver) {
+		r.removeThreshold = threshold
+	}}
+}
+
+// WithEvictOnErrors sets the predicate which reports whether a refresh error counts toward
+// removing the host set by `WithRemoveFailedHosts`. If `WithRemoveFailedHosts` is not set,
+// the host is removed on the first matching error.
+func WithEvictOnErrors(predicate func(err error) bool) Option {
+	return Option{apply: func(r *Resolver) {
+		r.evictOnErr = predicate
+	}}
+}
+
+// WithLookupRetries makes the resolver retry the lookup failed by a timeout or temporary
+// error (e.g. SERVFAIL) up to attempts times. It waits backoff before the first retry and
+// doubles it for each retry, as long as the context of the lookup allows. The lookup failed
+// because the host does not exist (NXDOMAIN) is not retried.
+func WithLookupRetries(attempts int, backoff time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		r.retries = attempts
+		r.retryBackoff = backoff
+	}}
+}
+
+// WithHostTimeout overrides the lookup timeout of the given host. It is used both for
+// refreshing and the lookup in `DialFunc` instead of the timeout given to `New` and
+// `WithDialLookupTimeout` option.
+func WithHostTimeout(host string, timeout time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		if r.hostTimeouts == nil {
+			r.hostTimeouts = make(map[string]time.Duration)
+		}
+		r.hostTimeouts[NormalizeHost(host)] = timeout
+	}}
+}
+
+// WithOnIPsChanged sets the function which is called when a lookup (including refreshing)
+// returns the different IP set from the cached one. It receives the IPs which are added
+// to and removed from the cache. It is not called when a host is cached for the first time.
+// It is called without holding the lock, so it may call the resolver.
+// It can be set multiple times and then all the functions are called in order.
+func WithOnIPsChanged(fn func(host string, added, removed []net.IP)) Option {
+	return Option{apply: func(r *Resolver) {
+		if fn == nil {
+			return
+		}
+		prev := r.onIPsChangedFn
+		if prev == nil {
+			r.onIPsChangedFn = fn
+			return
+		}
+		r.onIPsChangedFn = func(host string, added, removed []net.IP) {
+			prev(host, added, removed)
+			fn(host, added, removed)
+		}
+	}}
+}
+
+// WithOnChurn sets the function which is called when the IP set of a host changes threshold
+// times or more within a refresh window, i.e. between the refreshes every freq, to detect
+// the backends whose IP set flaps. It receives the number of the changes in the window and
+// is called on every change from the threshold-th one. A threshold less than 1 means 1.
+// It is called without holding the lock, so it may call the resolver. The total number of
+// the changes is reported by `Stats` regardless of this option.
+func WithOnChurn(threshold int, fn func(host string, changes int)) Option {
+	return Option{apply: func(r *Resolver) {
+		if threshold < 1 {
+			threshold = 1
+		}
+		r.churnThreshold = threshold
+		r.onChurnFn = fn
+	}}
+}
+
+// WithOnLookupError sets the function which is called when a DNS lookup of a host fails,
+// including the lookups by `Fetch` and refreshing. It receives the `*LookupError`.
+// Concurrent failed lookups of the same host share one call. It is called without
+// holding the lock, but it blocks the lookup, so it should return quickly, e.g. by
+// handing the error to another goroutine.
+func WithOnLookupError(fn func(host string, err error)) Option {
+	return Option{apply: func(r *Resolver) {
+		r.onLookupErrorFn = fn
+	}}
+}
+
+// WithRefreshBounds bounds how often an entry is refreshed. An entry is refreshed after its TTL
+// elapses, but not sooner than min nor later than max even if the TTL is shorter or longer.
+// The entry whose TTL is unknown is refreshed after min. Zero means no bound. Since entries
+// are refreshed by the ticker of freq, the actual refresh happens at the first tick after
+// the bound.
+func WithRefreshBounds(min, max time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		r.minRefresh = min
+		r.maxRefresh = max
+	}}
+}
+
+// WithIPFilter makes the resolver cache only the IPs for which the given predicate returns
+// true. The filtered IPs never enter the cache. If no IP is left, the lookup fails.
+// It can be set multiple times and then IPs must satisfy all the predicates.
+// See `ExcludePrivate` and `ExcludeLoopback` for the common predicates.
+func WithIPFilter(keep func(ip net.IP) bool) Option {
+	return Option{apply: func(r *Resolver) {
+		if keep != nil {
+			r.ipFilters = append(r.ipFilters, keep)
+		}
+	}}
+}
+
+// WithHostAllowlist makes the resolver cache only the given hosts. A host starting with
+// "*." matches its subdomains, e.g. "*.internal" matches "db.internal" but not "internal".
+// `DialFunc` dials the other hosts by the base dial function as they are, and `Fetch` and
+// `LookupIP` lookup them without the cache. By default or if no host is given, all hosts
+// are cached.
+func WithHostAllowlist(hosts []string) Option {
+	return Option{apply: func(r *Resolver) {
+		r.hostAllowlist = hostPatterns(hosts)
+	}}
+}
+
+// WithHostDenylist makes the resolver not cache the given hosts, which are matched like
+// `WithHostAllowlist` option. It takes precedence over the allowlist. The denied hosts are
+// handled as the hosts not on the allowlist.
+func WithHostDenylist(hosts []string) Option {
+	return Option{apply: func(r *Resolver) {
+		r.hostDenylist = hostPatterns(hosts)
+	}}
+}
+
+// WithMaxIPsPerHost limits the number of IPs cached per host to n. If a lookup returns more
+// IPs, n of them are chosen randomly. The IPs already cached are kept chosen on refresh
+// while they are still returned. Zero means no limit.
+func WithMaxIPsPerHost(n int) Option {
+	return Option{apply: func(r *Resolver) {
+		r.maxIPs = n
+	}}
+}
+
+// WithRandSource sets the random source used to decide the order of IPs to dial in
+// `DialFunc` (including by `WeightedOrderer`), to sample IPs by `WithMaxIPsPerHost`
+// option and to randomize the refresh interval by `WithRefreshJitter` option. It is
+// useful to make them deterministic in tests.
+// The source does not need to be safe for concurrent use. By default, the automatically
+// seeded global source of `math/rand/v2` is used.
+func WithRandSource(src rand.Source) Option {
+	return Option{apply: func(r *Resolver) {
+		if src != nil {
+			r.rand = rand.New(src)
+		}
+	}}
+}
+
+// WithCanonicalName makes the resolver capture the canonical name of each host, i.e. the
+// final target of its CNAME chain, and report it by `FetchWithMeta`. The IP list is still
+// cached by the given host. It costs an extra lookup per lookup of the IP list.
+func WithCanonicalName() Option {
+	return Option{apply: func(r *Resolver) {
+		r.captureCNAME = true
+	}}
+}
+
+// WithMaxLoadAge makes `LoadFromFile` ignore the entries which were looked up longer ago
+// than maxAge. By default, all entries are loaded.
+func WithMaxLoadAge(maxAge time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		r.maxLoadAge = maxAge
+	}}
+}
+
+// WithStore makes the resolver keep the cache entries in the given store instead of
+// the map in memory. The entries set by the options before it, e.g. `WithStaticEntries`,
+// are moved to the store.
+func WithStore(store Store) Option {
+	return Option{apply: func(r *Resolver) {
+		if store == nil {
+			return
+		}
+		r.forEachEntry(func(addr string, entry *Entry) {
+			store.Set(addr, entry)
+		})
+		r.cache = store
+	}}
+}
+
+// WithMaxEntryAge makes the resolver remove the entries which have not been fetched by
+// `Fetch` (or `DialFunc`) for longer than maxAge, so that the hosts no longer used are not
+// refreshed forever. They are removed on refresh. The static entries are never removed.
+// By default, entries are kept forever.
+func WithMaxEntryAge(maxAge time.Duration) Option {
+	return Option{apply: func(r *Resolver) {
+		r.maxEntryAge = maxAge
+	}}
+}
+
+// WithCacheSize limits the number of hosts in the cache to n. When a new host is cached
+// beyond the limit, the least recently fetched host is removed. The static entries are
+// not counted. By default, the number of hosts is not limited.
+func WithCacheSize(n int) Option {
+	return Option{apply: func(r *Resolver) {
+		r.maxEntries = n
+	}}
+}
+
+// WithOnEvict sets the function which is called when an entry is evicted by
+// `WithMaxEntryAge` or `WithCacheSize` option, e.g. to fetch the host again if it is
+// still in use. It is called once per evicted entry without holding the lock.
+// It can be set multiple times and then all the functions are called in order.
+func WithOnEvict(fn func(host string)) Option {
+	return Option{apply: func(r *Resolver) {
+		if fn == nil {
+			return
+		}
+		prev := r.onEvictFn
+		if prev == nil {
+			r.onEvictFn = fn
+			return
+		}
+		r.onEvictFn = func(host string) {
+			prev(host)
+			fn(host)
+		}
 	}}
 }
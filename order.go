@@ -0,0 +1,232 @@
+package dnscache
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPOrderer decides the order of IPs that `DialFunc` dials. Set it by `WithIPOrderer`
+// option to implement the ordering which `DialStrategy` does not provide, e.g. sorted
+// by latency. It must be safe for concurrent use.
+type IPOrderer interface {
+	// Order returns the IPs of the given host in the order to dial. The given IPs are
+	// a copy of the cache, so it may reorder them in place. `DialFunc` dials only the
+	// returned IPs.
+	Order(host string, ips []net.IP) []net.IP
+}
+
+// DialObserver is optionally implemented by IPOrderer to be notified of the result of
+// every dial by `DialFunc`, e.g. to order IPs by their health.
+type DialObserver interface {
+	// ObserveDial is called after dialing the IP of the given host. The err is nil
+	// if the dial succeeded. The dials aborted by the caller's context are not observed.
+	ObserveDial(host string, ip net.IP, err error)
+}
+
+// randOrderer is implemented by the IPOrderers which order IPs randomly, so that the
+// resolver makes them draw the random numbers from its random source.
+type randOrderer interface {
+	// orderRand is like `IPOrderer.Order` but draws the random numbers in [0.0, 1.0)
+	// from the given function.
+	orderRand(host string, ips []net.IP, random func() float64) []net.IP
+}
+
+// RandomOrderer is an IPOrderer which orders IPs randomly by the automatically
+// seeded global source. It is the same as the default `Random` strategy without
+// `WithRandSource` option.
+type RandomOrderer struct{}
+
+var _ IPOrderer = RandomOrderer{}
+
+// Order implements `IPOrderer`.
+func (RandomOrderer) Order(_ string, ips []net.IP) []net.IP {
+	ordered := make([]net.IP, len(ips))
+	for i, idx := range randPerm(len(ips)) {
+		ordered[i] = ips[idx]
+	}
+	return ordered
+}
+
+// orderIPs returns the IPs of the given host in the order to dial, decided by the
+// orderer set by `WithIPOrderer` option or the dial strategy.
+func (r *Resolver) orderIPs(host string, ips []net.IP) []net.IP {
+	if o, ok := r.ipOrderer.(randOrderer); ok {
+		return o.orderRand(host, ips, r.float64)
+	}
+	if r.ipOrderer != nil {
+		return r.ipOrderer.Order(host, ips)
+	}
+	ordered := make([]net.IP, len(ips))
+	for i, idx := range r.dialOrder(host, ips) {
+		ordered[i] = ips[idx]
+	}
+	return ordered
+}
+
+// FetchOne fetches IP list of the given addr like `Fetch` and returns one of them,
+// chosen in the same way as `DialFunc` decides the IP to dial first, i.e. by the orderer
+// set by `WithIPOrderer` option or the dial strategy (randomly by default). Use it to
+// balance the load across the IPs without dialing by `DialFunc`. The returned IP is
+// a copy of the cache, so it is safe to modify it.
+func (r *Resolver) FetchOne(ctx context.Context, addr string) (net.IP, error) {
+	ips, err := r.Fetch(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	ordered := r.orderIPs(addr, ips)
+	if len(ordered) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: addr}
+	}
+	return ordered[0], nil
+}
+
+// observeDial notifies the orderer of the result of dialing if it is a DialObserver.
+func (r *Resolver) observeDial(ctx context.Context, host string, ip net.IP, err error) {
+	observer, ok := r.ipOrderer.(DialObserver)
+	if !ok {
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	observer.ObserveDial(host, ip, err)
+}
+
+// minScoreCount is the decayed count of dials under which the score of an IP is
+// forgotten since it is almost neutral.
+const minScoreCount = 1e-3
+
+// WeightedOrderer is an IPOrderer which dials the IPs which have recently succeeded
+// more likely first, and the IPs which have recently failed less likely first. It
+// orders IPs randomly weighted by their scores, which are updated by the results of
+// dials as a DialObserver. The past results decay by half every half-life, so that
+// a recovered IP gets traffic again. The IPs never dialed have the neutral score.
+// The random numbers are drawn from the source set by `WithRandSource` option of the
+// resolver which it is set to, or the global source if it is called directly.
+type WeightedOrderer struct {
+	halfLife time.Duration
+
+	// now returns the current time. This is used to replace it when test.
+	now func() time.Time
+
+	mu     sync.Mutex
+	scores map[string]*ipScore
+}
+
+var (
+	_ IPOrderer    = (*WeightedOrderer)(nil)
+	_ DialObserver = (*WeightedOrderer)(nil)
+	_ randOrderer  = (*WeightedOrderer)(nil)
+)
+
+// ipScore is the decayed numbers of the successful and failed dials of an IP.
+type ipScore struct {
+	successes, failures float64
+	updatedAt           time.Time
+}
+
+// NewWeightedOrderer returns a WeightedOrderer whose scores decay by the given half-life.
+// Default half-life (if zero or negative) is one minute.
+func NewWeightedOrderer(halfLife time.Duration) *WeightedOrderer {
+	if halfLife <= 0 {
+		halfLife = time.Minute
+	}
+	return &WeightedOrderer{
+		halfLife: halfLife,
+		now:      time.Now,
+		scores:   make(map[string]*ipScore),
+	}
+}
+
+// Order implements `IPOrderer`.
+func (o *WeightedOrderer) Order(host string, ips []net.IP) []net.IP {
+	return o.orderRand(host, ips, rand.Float64)
+}
+
+// orderRand implements `randOrderer`.
+func (o *WeightedOrderer) orderRand(_ string, ips []net.IP, random func() float64) []net.IP {
+	weights := make([]float64, len(ips))
+	var sum float64
+	o.mu.Lock()
+	now := o.now()
+	for i, ip := range ips {
+		weights[i] = o.score(ipKey(ip), now)
+		sum += weights[i]
+	}
+	o.mu.Unlock()
+
+	ordered := make([]net.IP, 0, len(ips))
+	rest := append([]net.IP(nil), ips...)
+	for len(rest) > 0 {
+		n := random() * sum
+		i := 0
+		for ; i < len(rest)-1; i++ {
+			n -= weights[i]
+			if n < 0 {
+				break
+			}
+		}
+		ordered = append(ordered, rest[i])
+		sum -= weights[i]
+		rest = append(rest[:i], rest[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return ordered
+}
+
+// ObserveDial implements `DialObserver`.
+func (o *WeightedOrderer) ObserveDial(_ string, ip net.IP, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	key := ipKey(ip)
+	s, ok := o.scores[key]
+	if !ok {
+		s = &ipScore{updatedAt: now}
+		o.scores[key] = s
+	}
+	s.decay(now, o.halfLife)
+	if err != nil {
+		s.failures++
+	} else {
+		s.successes++
+	}
+}
+
+// Score returns the current score of the given IP in (0, 1), which is the weight to order
+// it. It is 0.5 for the IPs never dialed.
+func (o *WeightedOrderer) Score(ip net.IP) float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.score(ipKey(ip), o.now())
+}
+
+// score returns the score of the IP of the given key. The caller must hold the lock.
+func (o *WeightedOrderer) score(key string, now time.Time) float64 {
+	s, ok := o.scores[key]
+	if !ok {
+		return 0.5
+	}
+	s.decay(now, o.halfLife)
+	if s.successes+s.failures < minScoreCount {
+		delete(o.scores, key)
+	}
+	// The success rate smoothed by one success and one failure, so that it is never 0.
+	return (s.successes + 1) / (s.successes + s.failures + 2)
+}
+
+// decay decays the numbers of dials by the time elapsed since the last update.
+func (s *ipScore) decay(now time.Time, halfLife time.Duration) {
+	elapsed := now.Sub(s.updatedAt)
+	if elapsed <= 0 {
+		return
+	}
+	f := math.Exp2(-float64(elapsed) / float64(halfLife))
+	s.successes *= f
+	s.failures *= f
+	s.updatedAt = now
+}
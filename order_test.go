@@ -0,0 +1,192 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWeightedOrderer(t *testing.T) {
+	now := time.Now()
+	orderer := NewWeightedOrderer(time.Minute)
+	orderer.now = func() time.Time {
+		return now
+	}
+
+	failing, healthy := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	if got := orderer.Score(failing); got != 0.5 {
+		t.Fatalf("want neutral score 0.5, got %f", got)
+	}
+	for i := 0; i < 5; i++ {
+		orderer.ObserveDial("weighted.jp", failing, errors.New("err"))
+		orderer.ObserveDial("weighted.jp", healthy, nil)
+	}
+	if got, want := orderer.Score(failing), 1.0/7; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("want score %f, got %f", want, got)
+	}
+	if got, want := orderer.Score(healthy), 6.0/7; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("want score %f, got %f", want, got)
+	}
+
+	firstHealthy := 0
+	for i := 0; i < 1000; i++ {
+		ordered := orderer.Order("weighted.jp", []net.IP{failing, healthy})
+		if len(ordered) != 2 {
+			t.Fatalf("expect all IPs to be ordered, got %v", ordered)
+		}
+		if ordered[0].Equal(healthy) {
+			firstHealthy++
+		}
+	}
+	// The healthy IP is dialed first about 6/7 of the time.
+	if firstHealthy < 750 || firstHealthy > 950 {
+		t.Fatalf("expect healthy IP to be dialed first mostly, got %d/1000", firstHealthy)
+	}
+
+	// The scores decay by half every half-life.
+	now = now.Add(time.Minute)
+	if got, want := orderer.Score(failing), 1/(2.5+2); math.Abs(got-want) > 1e-9 {
+		t.Fatalf("want score %f, got %f", want, got)
+	}
+
+	// The recovered IP gets traffic again.
+	now = now.Add(time.Hour)
+	for _, ip := range []net.IP{failing, healthy} {
+		if got := orderer.Score(ip); math.Abs(got-0.5) > 1e-3 {
+			t.Fatalf("expect score of %s to be neutral, got %f", ip, got)
+		}
+	}
+}
+
+func TestDialFuncWeightedOrderer(t *testing.T) {
+	now := time.Now()
+	orderer := NewWeightedOrderer(time.Minute)
+	orderer.now = func() time.Time {
+		return now
+	}
+	resolver := &Resolver{
+		ipOrderer: orderer,
+		cache: mapStore{
+			"deeeet.com": {ips: []net.IP{
+				net.ParseIP("127.0.0.1"),
+				net.ParseIP("127.0.0.2"),
+			}},
+		},
+	}
+
+	dialF := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if h, _, _ := net.SplitHostPort(addr); h == "127.0.0.1" {
+			return nil, errors.New("err")
+		}
+		return nil, nil
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := DialFunc(resolver, dialF)(context.Background(), "tcp", "deeeet.com:443"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if got := orderer.Score(net.ParseIP("127.0.0.1")); got >= 0.5 {
+		t.Fatalf("expect the failing IP to be scored down, got %f", got)
+	}
+	if got := orderer.Score(net.ParseIP("127.0.0.2")); got <= 0.5 {
+		t.Fatalf("expect the healthy IP to be scored up, got %f", got)
+	}
+
+	// The dials aborted by the caller are not the failure of the IP.
+	ctx, cancelF := context.WithCancel(context.Background())
+	cancelF()
+	before := orderer.Score(net.ParseIP("127.0.0.2"))
+	_, _ = DialFunc(resolver, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, ctx.Err()
+	})(ctx, "tcp", "deeeet.com:443")
+	if got := orderer.Score(net.ParseIP("127.0.0.2")); got != before {
+		t.Fatalf("expect the score to be unchanged, want %f, got %f", before, got)
+	}
+}
+
+func TestWeightedOrdererRandSource(t *testing.T) {
+	ips := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}
+	fetched := func() []string {
+		resolver := &Resolver{
+			ipOrderer: NewWeightedOrderer(time.Minute),
+			rand:      rand.New(rand.NewPCG(1, 2)),
+			cache:     mapStore{"deeeet.com": {ips: ips}},
+		}
+		var fetched []string
+		for i := 0; i < 10; i++ {
+			ip, err := resolver.FetchOne(context.Background(), "deeeet.com")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			fetched = append(fetched, ip.String())
+		}
+		return fetched
+	}
+
+	want := fetched()
+	if got := fetched(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect the same order with the same source, want %v, got %v", want, got)
+	}
+}
+
+func TestFetchOne(t *testing.T) {
+	ips := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		resolver := &Resolver{
+			dialStrategy: RoundRobin,
+			cache:        mapStore{"deeeet.com": {ips: ips}},
+		}
+		for i := 0; i < 2*len(ips); i++ {
+			ip, err := resolver.FetchOne(context.Background(), "deeeet.com")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if want := ips[i%len(ips)]; !ip.Equal(want) {
+				t.Fatalf("#%d: want %s, got %s", i, want, ip)
+			}
+		}
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		resolver := &Resolver{
+			cache: mapStore{"deeeet.com": {ips: ips}},
+		}
+		const n = 3000
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			ip, err := resolver.FetchOne(context.Background(), "deeeet.com")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			counts[ip.String()]++
+		}
+		// Each IP is chosen n/3 times on average with the standard deviation about 26.
+		for _, ip := range ips {
+			if cnt := counts[ip.String()]; cnt < n/3-200 || cnt > n/3+200 {
+				t.Fatalf("expect %s to be chosen about %d times, got %d", ip, n/3, cnt)
+			}
+		}
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		resolver := &Resolver{
+			dialStrategy: Sequential,
+			cache:        mapStore{"deeeet.com": {ips: ips}},
+		}
+		ip, err := resolver.FetchOne(context.Background(), "deeeet.com")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		ip[len(ip)-1] = 9
+		if got := resolver.Entries()["deeeet.com"][0]; !got.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("expect the cache not to be modified, got %s", got)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// SaveToFile saves the cached hosts, their IP lists and when they were looked up
+// to the given file as JSON, so that `LoadFromFile` can restore them e.g. after restart.
+// The static entries are not saved. The file is replaced atomically.
+func (r *Resolver) SaveToFile(path string) error {
+	r.lock.RLock()
+	entries := make(map[string]entryJSON)
+	r.forEachEntry(func(addr string, entry *Entry) {
+		if entry.static || entry.invalidated {
+			return
+		}
+		entries[addr] = entryJSON{IPs: entry.ips, RefreshedAt: entry.refreshedAt, Zones: zonesJSON(entry.zones)}
+	})
+	data, err := json.Marshal(entries)
+	r.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFromFile loads the cache saved by `SaveToFile`. The entries which were looked up
+// longer ago than the max age set by `WithMaxLoadAge` option are ignored. The loaded
+// entries are refreshed on the next refresh as if their TTL is unknown. The hosts which
+// are already in the cache are kept as they are. The IP lists are filtered and limited
+// by the options in the same way as looked up, and the hosts which are not cached by
+// `WithHostAllowlist` or `WithHostDenylist` option are ignored.
+func (r *Resolver) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entries map[string]entryJSON
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	var evicted []string
+	defer func() {
+		r.logEvicted(evicted)
+	}()
+
+	now := r.now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for addr, entry := range entries {
+		if r.maxLoadAge > 0 && now.Sub(entry.RefreshedAt) > r.maxLoadAge {
+			continue
+		}
+		addr = NormalizeHost(addr)
+		if !r.cacheable(addr) {
+			continue
+		}
+		if _, ok := r.cache.Get(addr); ok {
+			continue
+		}
+		ips := r.filterIPs(r.family.filter(dedupeIPs(entry.IPs)))
+		if len(ips) == 0 {
+			continue
+		}
+		if r.maxIPs > 0 && len(ips) > r.maxIPs {
+			ips = r.sampleIPs(ips, nil, r.maxIPs)
+		}
+		if r.stableSort {
+			sortIPs(ips)
+		}
+		loaded := &Entry{ips: ips, refreshedAt: entry.RefreshedAt, zones: parseZonesJSON(entry.Zones)}
+		r.cache.Set(addr, loaded)
+		r.scheduleEntry(addr, loaded)
+		evicted = append(evicted, r.admit(addr)...)
+	}
+	return nil
+}
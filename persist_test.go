@@ -0,0 +1,158 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSaveToFile(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	clock := newFakeClock()
+	// The refresh must not make old.jp fresh while the clock is advanced.
+	saver, err := New(24*time.Hour, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithStaticEntries(map[string][]net.IP{
+			"static.jp": {net.IPv4(10, 0, 0, 2)},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer saver.Stop()
+
+	if _, err := saver.Fetch(context.Background(), "old.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := saver.Fetch(context.Background(), "new.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dnscache.json")
+	if err := saver.SaveToFile(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Nothing is looked up on load.
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		t.Fatalf("expect no lookup: %s", host)
+		return nil, 0, nil
+	}
+
+	cases := []struct {
+		name   string
+		maxAge time.Duration
+		want   map[string][]net.IP
+	}{
+		{
+			name: "All",
+			want: map[string][]net.IP{
+				"old.jp": {net.IPv4(10, 0, 0, 1)},
+				"new.jp": {net.IPv4(10, 0, 0, 1)},
+			},
+		},
+		{
+			name:   "DropStale",
+			maxAge: 30 * time.Minute,
+			want: map[string][]net.IP{
+				"new.jp": {net.IPv4(10, 0, 0, 1)},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, err := New(time.Hour, testDefaultLookupTimeout, WithClock(clock), WithMaxLoadAge(tc.maxAge))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer loader.Stop()
+
+			if err := loader.LoadFromFile(path); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			got := loader.Entries()
+			for host, ips := range got {
+				got[host] = normalizeIPs(ips)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+
+			_, meta, err := loader.FetchWithMeta(context.Background(), "new.jp")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !meta.Hit || !meta.LastRefreshed.Equal(clock.Now()) {
+				t.Fatalf("expect loaded entry to keep the refreshed time, got %+v", meta)
+			}
+		})
+	}
+}
+
+func TestLoadFromFileNotExist(t *testing.T) {
+	resolver := testResolver(t)
+	defer resolver.Stop()
+
+	if err := resolver.LoadFromFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("expect error")
+	}
+}
+
+func TestLoadFromFileOptions(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(10, 0, 0, 2)}, {IP: net.IPv4(10, 0, 0, 3)}}, 0, nil
+	}
+
+	saver := testResolver(t)
+	defer saver.Stop()
+	for _, host := range []string{"allowed.jp", "denied.jp"} {
+		if _, err := saver.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "dnscache.json")
+	if err := saver.SaveToFile(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The denied host is neither loaded nor refreshed.
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "denied.jp" {
+			t.Errorf("expect no lookup: %s", host)
+		}
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	loader, err := New(time.Hour, testDefaultLookupTimeout, WithHostDenylist([]string{"denied.jp"}), WithMaxIPsPerHost(2))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer loader.Stop()
+
+	if err := loader.LoadFromFile(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	got := loader.Entries()
+	if len(got) != 1 || len(got["allowed.jp"]) != 2 {
+		t.Fatalf("expect only allowed.jp with 2 IPs, got %v", got)
+	}
+	loader.Refresh()
+}
@@ -0,0 +1,92 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// requestResolverKey is the context key of requestResolver.
+type requestResolverKey struct{}
+
+// requestResolver is the lookup function which overrides the resolver's one for the
+// requests with the context returned by `WithRequestResolver`.
+type requestResolver struct {
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+
+	// cache is true if the IP lists looked up by it are saved in the cache.
+	cache bool
+}
+
+// WithRequestResolver returns a copy of the given context with which `Fetch` and `LookupIP`
+// (and `DialFunc`) lookup IP list by the given function instead of the resolver's one,
+// e.g. to resolve the hosts of a tenant by its own DNS view. The result is neither served
+// from nor saved in the cache, so that it does not affect the other requests, though
+// the IP filters and the limits of the DNS queries are applied as usual. The static entries
+// and the negative cache are not consulted either.
+func WithRequestResolver(ctx context.Context, fn func(ctx context.Context, host string) ([]net.IP, error)) context.Context {
+	return context.WithValue(ctx, requestResolverKey{}, &requestResolver{lookupIP: fn})
+}
+
+// WithCachingRequestResolver is like `WithRequestResolver` but the IP lists which are not
+// in the cache are looked up by the given function and saved in the shared cache, so that
+// the other requests are served them. Note that the concurrent lookups of the same host are
+// shared regardless of the context, and the cached hosts are refreshed by the resolver's
+// lookup function.
+func WithCachingRequestResolver(ctx context.Context, fn func(ctx context.Context, host string) ([]net.IP, error)) context.Context {
+	return context.WithValue(ctx, requestResolverKey{}, &requestResolver{lookupIP: fn, cache: true})
+}
+
+// requestResolverOf returns the request resolver of the given context, or nil if it has none.
+func requestResolverOf(ctx context.Context) *requestResolver {
+	rr, _ := ctx.Value(requestResolverKey{}).(*requestResolver)
+	return rr
+}
+
+// lookupFunc returns the function to lookup IP list with the given context.
+func (r *Resolver) lookupFunc(ctx context.Context) func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if rr := requestResolverOf(ctx); rr != nil {
+		return func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+			ips, err := rr.lookupIP(ctx, host)
+			return ipAddrsOf(ips), 0, err
+		}
+	}
+	return r.lookupIPFn
+}
+
+// bypassCache reports whether the IP list of the given addr is looked up without the cache
+// with the given context, i.e. the context has the request resolver which does not cache
+// or the addr is not cached by `WithHostAllowlist` or `WithHostDenylist` option.
+func (r *Resolver) bypassCache(ctx context.Context, addr string) bool {
+	if rr := requestResolverOf(ctx); rr != nil && !rr.cache {
+		return true
+	}
+	return !r.cacheable(addr)
+}
+
+// lookupUncached lookups IP list of the given addr by the lookup function for the given
+// context without the cache.
+func (r *Resolver) lookupUncached(ctx context.Context, addr string) ([]net.IP, error) {
+	done, err := r.startQuery(ctx)
+	if err != nil {
+		return nil, &LookupError{Host: addr, Err: err}
+	}
+	start := r.now()
+	addrs, _, err := r.lookupFunc(ctx)(ctx, addr)
+	done()
+	r.counters.observeLookup(r.now().Sub(start), err)
+	if err != nil {
+		err = &LookupError{Host: addr, Err: err}
+		r.onLookupError(addr, err)
+		return nil, err
+	}
+
+	ips, _ := splitZones(addrs)
+	ips = r.filterIPs(r.family.filter(dedupeIPs(ips)))
+	if len(ips) == 0 {
+		err := &LookupError{Host: addr, Err: &net.AddrError{Err: "no suitable address found", Addr: addr}}
+		r.onLookupError(addr, err)
+		return nil, err
+	}
+	return copyIPs(ips), nil
+}
@@ -0,0 +1,105 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithRequestResolver(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	var tenantCalled int32
+	ctx := WithRequestResolver(context.Background(), func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&tenantCalled, 1)
+		return []net.IP{net.IPv4(192, 168, 0, 1)}, nil
+	})
+
+	tenantIPs := []net.IP{net.IPv4(192, 168, 0, 1)}
+	ips, err := resolver.Fetch(ctx, "tenant.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(ips, tenantIPs) {
+		t.Fatalf("want %v, got %v", tenantIPs, ips)
+	}
+	if resolver.Len() != 0 {
+		t.Fatalf("expect the cache not to be modified, got %v", resolver.Entries())
+	}
+
+	// The cached IP list of the default view is not served to the overridden context.
+	if _, err := resolver.Fetch(context.Background(), "tenant.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ips, err = resolver.LookupIP(ctx, "tenant.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(ips, tenantIPs) {
+		t.Fatalf("want %v, got %v", tenantIPs, ips)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(resolver.Entries()["tenant.jp"], want) {
+		t.Fatalf("want %v, got %v", want, resolver.Entries()["tenant.jp"])
+	}
+	if cnt := atomic.LoadInt32(&tenantCalled); cnt != 2 {
+		t.Fatalf("expect the request resolver to be called 2 times, called %d times", cnt)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect the default lookup to be called once, called %d times", cnt)
+	}
+}
+
+func TestWithCachingRequestResolver(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var called int32
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&called, 1)
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ctx := WithCachingRequestResolver(context.Background(), func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(192, 168, 0, 1)}, nil
+	})
+	if _, err := resolver.Fetch(ctx, "tenant.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ips, err := resolver.Fetch(context.Background(), "tenant.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(192, 168, 0, 1)}; !reflect.DeepEqual(ips, want) {
+		t.Fatalf("want %v, got %v", want, ips)
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 0 {
+		t.Fatalf("expect the default lookup not to be called, called %d times", cnt)
+	}
+}
@@ -0,0 +1,203 @@
+package dnscache
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduledHost is a host in refreshQueue.
+type scheduledHost struct {
+	addr  string
+	at    time.Time
+	index int
+}
+
+// refreshQueue is a min-heap of the hosts ordered by when they are refreshed next.
+// It implements `heap.Interface`.
+type refreshQueue []*scheduledHost
+
+func (q refreshQueue) Len() int {
+	return len(q)
+}
+
+func (q refreshQueue) Less(i, j int) bool {
+	return q[i].at.Before(q[j].at)
+}
+
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *refreshQueue) Push(x any) {
+	h := x.(*scheduledHost)
+	h.index = len(*q)
+	*q = append(*q, h)
+}
+
+func (q *refreshQueue) Pop() any {
+	old := *q
+	h := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return h
+}
+
+// scheduler keeps when each host is refreshed next for `WithExpiryScheduler` option.
+type scheduler struct {
+	mu    sync.Mutex
+	queue refreshQueue
+	hosts map[string]*scheduledHost
+
+	// wake is notified when the earliest deadline is moved earlier.
+	wake chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		hosts: make(map[string]*scheduledHost),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// schedule sets when the given host is refreshed next, replacing the current schedule.
+func (s *scheduler) schedule(addr string, at time.Time) {
+	s.mu.Lock()
+	h, ok := s.hosts[addr]
+	if ok {
+		h.at = at
+		heap.Fix(&s.queue, h.index)
+	} else {
+		h = &scheduledHost{addr: addr, at: at}
+		heap.Push(&s.queue, h)
+		s.hosts[addr] = h
+	}
+	earliest := s.queue[0] == h
+	s.mu.Unlock()
+
+	if earliest {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule forgets the schedule of the given host. It does nothing if it is not scheduled.
+func (s *scheduler) unschedule(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.hosts[addr]; ok {
+		heap.Remove(&s.queue, h.index)
+		delete(s.hosts, addr)
+	}
+}
+
+// next returns the earliest deadline. It reports whether any host is scheduled.
+func (s *scheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return time.Time{}, false
+	}
+	return s.queue[0].at, true
+}
+
+// due removes the hosts which are due at the given time from the schedule and returns
+// them in the order of their deadlines.
+func (s *scheduler) due(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for len(s.queue) > 0 && !now.Before(s.queue[0].at) {
+		h := heap.Pop(&s.queue).(*scheduledHost)
+		delete(s.hosts, h.addr)
+		addrs = append(addrs, h.addr)
+	}
+	return addrs
+}
+
+// scheduleEntry schedules the refresh of the given entry if `WithExpiryScheduler` option
+// is set.
+func (r *Resolver) scheduleEntry(addr string, entry *Entry) {
+	if r.sched == nil || entry.static {
+		return
+	}
+	r.sched.schedule(addr, r.refreshAt(entry))
+}
+
+// refreshAt returns when the given non-static entry is due for refresh, i.e. when its TTL
+// elapses, or freq after it was looked up if the TTL is unknown. The invalidated entry is
+// due immediately.
+func (r *Resolver) refreshAt(entry *Entry) time.Time {
+	switch {
+	case entry.invalidated:
+		return r.now()
+	case r.fixedFreq || entry.expireAt.IsZero():
+		return entry.refreshedAt.Add(r.freq)
+	default:
+		return entry.expireAt
+	}
+}
+
+// runScheduler refreshes the scheduled hosts when they are due until the context is done.
+// It uses a ticker of the clock as the timer, which is reset to the earliest deadline
+// every time it fires or the earliest deadline moves earlier.
+func (r *Resolver) runScheduler(ctx context.Context) {
+	timer := r.clockOrDefault().NewTicker(r.untilNextSchedule())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			// The due hosts are kept scheduled while paused and refreshed on resume.
+			if !r.paused.Load() {
+				r.refreshDue(ctx)
+			}
+		case <-r.sched.wake:
+		case <-ctx.Done():
+			return
+		}
+		timer.Reset(r.untilNextSchedule())
+	}
+}
+
+// untilNextSchedule returns the duration until the earliest deadline, or freq if no host
+// is scheduled or the refresh is paused.
+func (r *Resolver) untilNextSchedule() time.Duration {
+	at, ok := r.sched.next()
+	if !ok || r.paused.Load() {
+		return r.freq
+	}
+	// The timer does not accept non-positive durations.
+	if d := at.Sub(r.now()); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+// refreshDue refreshes the hosts which are due. The successful refresh schedules the host
+// again by its new TTL. The host which fails to refresh is retried after freq.
+func (r *Resolver) refreshDue(ctx context.Context) {
+	addrs := r.sched.due(r.now())
+	concurrency := r.refreshConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	forEachConcurrently(addrs, concurrency, func(addr string) {
+		if ctx.Err() != nil {
+			return
+		}
+		// The host may have been removed since it was scheduled.
+		if entry, ok := r.getEntry(addr); !ok || entry.static {
+			return
+		}
+		if err := r.refreshAddr(ctx, addr); err != nil && ctx.Err() == nil {
+			if _, ok := r.getEntry(addr); ok {
+				r.sched.schedule(addr, r.now().Add(r.freq))
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpiryScheduler(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	ttls := map[string]time.Duration{
+		"short.jp": 5 * time.Second,
+		"long.jp":  12 * time.Second,
+		// The host whose TTL is unknown is refreshed every freq.
+		"unknown.jp": 0,
+	}
+	looked := make(chan string, 10)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		looked <- host
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, ttls[host], nil
+	}
+
+	clock := newFakeClock()
+	start := clock.Now()
+	resolver, err := New(time.Minute, testDefaultLookupTimeout,
+		WithClock(clock),
+		WithExpiryScheduler(),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for _, host := range []string{"short.jp", "long.jp", "unknown.jp"} {
+		if _, err := resolver.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		<-looked
+	}
+
+	// waitTimer waits until the timer of the scheduler is set to the given time.
+	waitTimer := func(at time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			clock.mu.Lock()
+			for _, ticker := range clock.tickers {
+				if !ticker.stopped && ticker.next.Equal(start.Add(at)) {
+					clock.mu.Unlock()
+					return
+				}
+			}
+			clock.mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expect the timer to be set to %v", at)
+	}
+
+	var got []string
+	now := time.Duration(0)
+	for _, at := range []time.Duration{5 * time.Second, 10 * time.Second, 12 * time.Second, 15 * time.Second} {
+		waitTimer(at)
+		if next := resolver.NextRefresh(); !next.Equal(start.Add(at)) {
+			t.Fatalf("want next refresh at %v, got %v", at, next.Sub(start))
+		}
+		clock.Advance(at - now)
+		now = at
+		select {
+		case host := <-looked:
+			got = append(got, host)
+		case <-time.After(time.Second):
+			t.Fatalf("expect a host to be refreshed at %v", at)
+		}
+	}
+
+	want := []string{"short.jp", "short.jp", "long.jp", "short.jp"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	select {
+	case host := <-looked:
+		t.Fatalf("expect no other refresh, got %s", host)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler()
+	base := time.Date(2018, 11, 13, 0, 0, 0, 0, time.UTC)
+	s.schedule("a.jp", base.Add(3*time.Second))
+	s.schedule("b.jp", base.Add(1*time.Second))
+	s.schedule("c.jp", base.Add(2*time.Second))
+	// Rescheduling replaces the deadline.
+	s.schedule("a.jp", base)
+	s.unschedule("c.jp")
+
+	if at, ok := s.next(); !ok || !at.Equal(base) {
+		t.Fatalf("want %v, got %v", base, at)
+	}
+	if got, want := s.due(base.Add(5*time.Second)), []string{"a.jp", "b.jp"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if _, ok := s.next(); ok {
+		t.Fatalf("expect nothing to be scheduled")
+	}
+}
@@ -0,0 +1,191 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sort"
+)
+
+// lookupSRV lookups SRV records of the given service. This is used to replace
+// lookup function when test.
+var lookupSRV = func(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
+	return srvs, err
+}
+
+// srvEntry is a cached SRV lookup result. Like Entry, it is never modified
+// once it is stored in the cache.
+type srvEntry struct {
+	service, proto, name string
+	srvs                 []*net.SRV
+}
+
+// srvName returns the name which is looked up for the given service, e.g.
+// "_grpc._tcp.service". It is used as the cache key.
+func srvName(service, proto, name string) string {
+	name = NormalizeHost(name)
+	if service == "" && proto == "" {
+		return name
+	}
+	return "_" + NormalizeHost(service) + "._" + NormalizeHost(proto) + "." + name
+}
+
+// LookupSRV fetches SRV records of the given service from the cache like `Fetch`.
+// If they are not in the cache, it lookups DNS and saves the result in the cache.
+// The cached services are refreshed every freq with the IP list cache.
+// The arguments are the same as `net.Resolver.LookupSRV`.
+//
+// The returned records are sorted by priority and randomized by weight within the
+// same priority, as described in RFC 2782. They are copies of the cache, so it is safe
+// to modify them.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	key := srvName(service, proto, name)
+	r.lock.RLock()
+	entry, ok := r.srvCache[key]
+	r.lock.RUnlock()
+	if ok {
+		r.counters.cacheHits.Add(1)
+		return r.orderSRV(entry.srvs), nil
+	}
+	r.counters.cacheMisses.Add(1)
+
+	srvs, err := r.lookupSRVEntry(ctx, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+	return r.orderSRV(srvs), nil
+}
+
+// lookupSRVEntry lookups SRV records of the given service and saves them in the cache.
+// Concurrent calls for the same service share one DNS lookup and its result like `LookupIP`.
+func (r *Resolver) lookupSRVEntry(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	key := srvName(service, proto, name)
+	// Prefix the key not to share the lookup with the IP list of the same name.
+	ch := r.group.DoChan("srv:"+key, func() (interface{}, error) {
+		ctx, cancelF := r.sharedContext(ctx, name)
+		defer cancelF()
+		done, err := r.startQuery(ctx)
+		if err != nil {
+			return nil, &LookupError{Host: key, Err: err}
+		}
+		start := r.now()
+		srvs, err := r.lookupSRVFn(ctx, service, proto, name)
+		done()
+		r.counters.observeLookup(r.now().Sub(start), err)
+		if err != nil {
+			return nil, &LookupError{Host: key, Err: err}
+		}
+
+		entry := &srvEntry{
+			service: service,
+			proto:   proto,
+			name:    name,
+			srvs:    copySRVs(srvs),
+		}
+		r.lock.Lock()
+		if r.srvCache == nil {
+			r.srvCache = make(map[string]*srvEntry)
+		}
+		r.srvCache[key] = entry
+		r.lock.Unlock()
+		return entry.srvs, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]*net.SRV), nil
+	case <-ctx.Done():
+		return nil, &LookupError{Host: key, Err: ctx.Err()}
+	}
+}
+
+// refreshSRV refreshes all the cached services. Like the IP list cache, the services
+// which fail to be refreshed are kept serving. It returns the errors of the services.
+func (r *Resolver) refreshSRV(ctx context.Context) []error {
+	r.lock.RLock()
+	entries := make([]*srvEntry, 0, len(r.srvCache))
+	for _, entry := range r.srvCache {
+		entries = append(entries, entry)
+	}
+	r.lock.RUnlock()
+
+	var errs []error
+	for _, entry := range entries {
+		lookupCtx, cancelF := context.WithTimeout(ctx, r.lookupTimeout(entry.name, r.refreshLookupTimeout))
+		_, err := r.lookupSRVEntry(lookupCtx, entry.service, entry.proto, entry.name)
+		cancelF()
+		if err != nil {
+			r.counters.refreshFailures.Add(1)
+			r.log().Error("failed to refresh SRV cache",
+				"error", err,
+				"service", srvName(entry.service, entry.proto, entry.name),
+			)
+			errs = append(errs, err)
+			continue
+		}
+		r.counters.refreshSuccesses.Add(1)
+	}
+	return errs
+}
+
+// orderSRV returns a copy of the given records sorted by priority and randomized by
+// weight within the same priority by the resolver's random source.
+func (r *Resolver) orderSRV(srvs []*net.SRV) []*net.SRV {
+	ordered := copySRVs(srvs)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+		r.shuffleByWeight(ordered[start:end])
+		start = end
+	}
+	return ordered
+}
+
+// shuffleByWeight orders the given records of the same priority by the weighted random
+// selection described in RFC 2782.
+func (r *Resolver) shuffleByWeight(srvs []*net.SRV) {
+	var sum int
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+
+	for i := range srvs {
+		if sum == 0 {
+			// Only the records of weight 0 are left.
+			rest := copySRVs(srvs[i:])
+			for j, k := range r.perm(len(rest)) {
+				srvs[i+j] = rest[k]
+			}
+			return
+		}
+
+		n := int(r.float64() * float64(sum))
+		for j := i; j < len(srvs); j++ {
+			n -= int(srvs[j].Weight)
+			if n < 0 {
+				srvs[i], srvs[j] = srvs[j], srvs[i]
+				break
+			}
+		}
+		sum -= int(srvs[i].Weight)
+	}
+}
+
+// copySRVs returns a deep copy of the given records so that callers can not modify
+// the cached ones.
+func copySRVs(srvs []*net.SRV) []*net.SRV {
+	copied := make([]*net.SRV, len(srvs))
+	for i, srv := range srvs {
+		c := *srv
+		copied[i] = &c
+	}
+	return copied
+}
@@ -0,0 +1,123 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupSRV(t *testing.T) {
+	originalFunc := lookupSRV
+	defer func() {
+		lookupSRV = originalFunc
+	}()
+
+	var (
+		called  int32
+		mu      sync.Mutex
+		srvs    = []*net.SRV{{Target: "a.service.", Port: 8080, Priority: 10, Weight: 1}}
+		lookErr error
+	)
+	lookupSRV = func(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+		atomic.AddInt32(&called, 1)
+		if service != "grpc" || proto != "tcp" || name != "service" {
+			t.Errorf("unexpected lookup: %s %s %s", service, proto, name)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return srvs, lookErr
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	want := []*net.SRV{{Target: "a.service.", Port: 8080, Priority: 10, Weight: 1}}
+	for i := 0; i < 2; i++ {
+		got, err := resolver.LookupSRV(context.Background(), "grpc", "tcp", "service")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+		// Modifying the result must not affect the cache.
+		got[0].Port = 0
+	}
+	if cnt := atomic.LoadInt32(&called); cnt != 1 {
+		t.Fatalf("expect to be cached, called %d times", cnt)
+	}
+
+	mu.Lock()
+	srvs = []*net.SRV{{Target: "b.service.", Port: 8080, Priority: 10, Weight: 1}}
+	mu.Unlock()
+	resolver.Refresh()
+	got, err := resolver.LookupSRV(context.Background(), "grpc", "tcp", "service")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := "b.service."; got[0].Target != want {
+		t.Fatalf("expect to be refreshed to %s, got %s", want, got[0].Target)
+	}
+
+	// The cache is kept when refreshing fails.
+	mu.Lock()
+	lookErr = errors.New("err")
+	mu.Unlock()
+	if err := resolver.RefreshContext(context.Background()); err == nil {
+		t.Fatalf("expect refresh to fail")
+	}
+	got, err = resolver.LookupSRV(context.Background(), "grpc", "tcp", "service")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := "b.service."; got[0].Target != want {
+		t.Fatalf("expect cache to be kept, got %s", got[0].Target)
+	}
+}
+
+func TestLookupSRVOrder(t *testing.T) {
+	originalFunc := lookupSRV
+	defer func() {
+		lookupSRV = originalFunc
+	}()
+
+	lookupSRV = func(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+		return []*net.SRV{
+			{Target: "backup.", Priority: 20, Weight: 1},
+			{Target: "light.", Priority: 10, Weight: 1},
+			{Target: "heavy.", Priority: 10, Weight: 99},
+		}, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithRandSource(rand.NewPCG(1, 2)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		got, err := resolver.LookupSRV(context.Background(), "", "", "_grpc._tcp.service")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if got[2].Target != "backup." {
+			t.Fatalf("expect the lower priority to be last, got %s", got[2].Target)
+		}
+		if got[0].Target == "heavy." {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 90 {
+		t.Fatalf("expect the heavier weight to be first mostly, got %d times", heavyFirst)
+	}
+}
@@ -0,0 +1,250 @@
+package dnscache
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupLatencyBounds is the upper bounds of the buckets of the DNS lookup
+// latency histogram.
+var lookupLatencyBounds = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Stats is statistics of the resolver cache.
+type Stats struct {
+	// CacheHits is the number of `Fetch` calls served from the cache.
+	CacheHits uint64
+
+	// CacheMisses is the number of `Fetch` calls which looked up DNS.
+	CacheMisses uint64
+
+	// RefreshSuccesses is the number of hosts successfully refreshed.
+	RefreshSuccesses uint64
+
+	// RefreshFailures is the number of hosts failed to refresh.
+	RefreshFailures uint64
+
+	// Lookups is the number of DNS lookups.
+	Lookups uint64
+
+	// LookupErrors is the number of failed DNS lookups.
+	LookupErrors uint64
+
+	// IPSetChanges is the number of lookups (including refreshing) which changed the
+	// cached IP set of a host.
+	IPSetChanges uint64
+
+	// LookupLatency is the latency histogram of DNS lookups.
+	LookupLatency Histogram
+
+	// Entries is the current number of cached hosts.
+	Entries int
+}
+
+// Histogram is a latency histogram.
+type Histogram struct {
+	// Count is the number of observations.
+	Count uint64
+
+	// Sum is the sum of observed durations.
+	Sum time.Duration
+
+	// Bounds is the upper bounds of the buckets.
+	Bounds []time.Duration
+
+	// Buckets is the cumulative number of observations which are less than
+	// or equal to the corresponding bound in Bounds.
+	Buckets []uint64
+}
+
+// counters holds the atomic counters of the resolver statistics.
+type counters struct {
+	cacheHits        atomic.Uint64
+	cacheMisses      atomic.Uint64
+	refreshSuccesses atomic.Uint64
+	refreshFailures  atomic.Uint64
+	lookups          atomic.Uint64
+	lookupErrors     atomic.Uint64
+	ipSetChanges     atomic.Uint64
+
+	// lookupLatencySum is the sum of lookup latency in nanoseconds.
+	lookupLatencySum atomic.Int64
+
+	// lookupLatencyBuckets is the non-cumulative number of observations
+	// per bucket. The last one is for observations above all bounds.
+	lookupLatencyBuckets [len(lookupLatencyBounds) + 1]atomic.Uint64
+}
+
+// observeLookup records the result of a DNS lookup.
+func (c *counters) observeLookup(took time.Duration, err error) {
+	c.lookups.Add(1)
+	if err != nil {
+		c.lookupErrors.Add(1)
+	}
+	c.lookupLatencySum.Add(int64(took))
+
+	i := 0
+	for i < len(lookupLatencyBounds) && took > lookupLatencyBounds[i] {
+		i++
+	}
+	c.lookupLatencyBuckets[i].Add(1)
+}
+
+// lookupLatency returns the snapshot of the lookup latency histogram.
+func (c *counters) lookupLatency() Histogram {
+	h := Histogram{
+		Sum:     time.Duration(c.lookupLatencySum.Load()),
+		Bounds:  append([]time.Duration(nil), lookupLatencyBounds[:]...),
+		Buckets: make([]uint64, len(lookupLatencyBounds)),
+	}
+	for i := range c.lookupLatencyBuckets {
+		h.Count += c.lookupLatencyBuckets[i].Load()
+		if i < len(h.Buckets) {
+			h.Buckets[i] = h.Count
+		}
+	}
+	return h
+}
+
+// Stats returns the current statistics of the resolver.
+func (r *Resolver) Stats() Stats {
+	entries := r.Len()
+
+	return Stats{
+		CacheHits:        r.counters.cacheHits.Load(),
+		CacheMisses:      r.counters.cacheMisses.Load(),
+		RefreshSuccesses: r.counters.refreshSuccesses.Load(),
+		RefreshFailures:  r.counters.refreshFailures.Load(),
+		Lookups:          r.counters.lookups.Load(),
+		LookupErrors:     r.counters.lookupErrors.Load(),
+		IPSetChanges:     r.counters.ipSetChanges.Load(),
+		LookupLatency:    r.counters.lookupLatency(),
+		Entries:          entries,
+	}
+}
+
+// ResetStats resets the counters of the resolver statistics.
+func (r *Resolver) ResetStats() {
+	r.counters.cacheHits.Store(0)
+	r.counters.cacheMisses.Store(0)
+	r.counters.refreshSuccesses.Store(0)
+	r.counters.refreshFailures.Store(0)
+	r.counters.lookups.Store(0)
+	r.counters.lookupErrors.Store(0)
+	r.counters.ipSetChanges.Store(0)
+	r.counters.lookupLatencySum.Store(0)
+	for i := range r.counters.lookupLatencyBuckets {
+		r.counters.lookupLatencyBuckets[i].Store(0)
+	}
+}
+
+// expvarLock serializes `PublishExpvar` so that the name is not published between
+// checking and publishing it.
+var expvarLock sync.Mutex
+
+// PublishExpvar publishes the statistics of the resolver as an expvar variable of the
+// given name, e.g. to expose them at /debug/vars. The variable reads the same counters
+// as `Stats` whenever it is read. Unlike `expvar.Publish`, it returns an error instead
+// of panicking if the name is already in use, since an expvar variable can not be
+// unpublished.
+func (r *Resolver) PublishExpvar(name string) error {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+	if expvar.Get(name) != nil {
+		return errors.New("dnscache: expvar " + name + " is already published")
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		stats := r.Stats()
+		return map[string]any{
+			"cache_hits":        stats.CacheHits,
+			"cache_misses":      stats.CacheMisses,
+			"refresh_successes": stats.RefreshSuccesses,
+			"refresh_failures":  stats.RefreshFailures,
+			"lookups":           stats.Lookups,
+			"lookup_errors":     stats.LookupErrors,
+			"ip_set_changes":    stats.IPSetChanges,
+			"entries":           stats.Entries,
+		}
+	}))
+	return nil
+}
+
+// HostStats is the refresh failure statistics of a cached host.
+type HostStats struct {
+	// ConsecutiveFailures is the number of refresh failures since the last successful
+	// lookup.
+	ConsecutiveFailures int
+
+	// TotalFailures is the number of refresh failures since the host was cached.
+	TotalFailures int
+
+	// LastError is the error of the last refresh failure. It is kept after the host
+	// is looked up successfully.
+	LastError error
+}
+
+// hostFailures is the refresh failures of a host.
+type hostFailures struct {
+	consecutive int
+	total       int
+
+	// evictable is the number of consecutive failures which count toward
+	// removing the host.
+	evictable int
+
+	lastErr error
+}
+
+// resetFailures resets the consecutive failures of the given addr looked up successfully.
+// The caller must hold the lock.
+func (r *Resolver) resetFailures(addr string) {
+	if f, ok := r.failures[addr]; ok {
+		f.consecutive = 0
+		f.evictable = 0
+		r.failures[addr] = f
+	}
+}
+
+// recordChurn counts the change of the IP set of the given addr and returns the number
+// of its changes in the current refresh window. It returns 0 unless `WithOnChurn`
+// option is set. The caller must hold the lock.
+func (r *Resolver) recordChurn(addr string) int {
+	r.counters.ipSetChanges.Add(1)
+	if r.onChurnFn == nil {
+		return 0
+	}
+	if r.churn == nil {
+		r.churn = make(map[string]int)
+	}
+	r.churn[addr]++
+	return r.churn[addr]
+}
+
+// HostStats returns the refresh failure statistics of the given host. It returns
+// the zero value if the host has never failed to be refreshed or is not in the cache.
+func (r *Resolver) HostStats(host string) HostStats {
+	host = NormalizeHost(host)
+	r.lock.RLock()
+	f := r.failures[host]
+	r.lock.RUnlock()
+	return HostStats{
+		ConsecutiveFailures: f.consecutive,
+		TotalFailures:       f.total,
+		LastError:           f.lastErr,
+	}
+}
@@ -0,0 +1,267 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "fail.jp" {
+			return nil, 0, fmt.Errorf("err")
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	ctx := context.Background()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	for _, host := range []string{"a.jp", "a.jp", "b.jp", "a.jp"} {
+		if _, err := resolver.Fetch(ctx, host); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	resolver.cache.Set("fail.jp", &Entry{ips: []net.IP{net.IP("10.0.0.2")}})
+	resolver.Refresh()
+
+	got := resolver.Stats()
+	want := Stats{
+		CacheHits:        2,
+		CacheMisses:      2,
+		RefreshSuccesses: 2,
+		RefreshFailures:  1,
+		Lookups:          5,
+		LookupErrors:     1,
+		LookupLatency:    got.LookupLatency,
+		Entries:          3,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+	if got.LookupLatency.Count != 5 {
+		t.Fatalf("want 5 latency observations, got %d", got.LookupLatency.Count)
+	}
+	if n := len(got.LookupLatency.Buckets); n != len(lookupLatencyBounds) {
+		t.Fatalf("want %d buckets, got %d", len(lookupLatencyBounds), n)
+	}
+
+	resolver.ResetStats()
+	got = resolver.Stats()
+	want = Stats{
+		LookupLatency: Histogram{
+			Bounds:  lookupLatencyBounds[:],
+			Buckets: make([]uint64, len(lookupLatencyBounds)),
+		},
+		Entries: 3,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestObserveLookup(t *testing.T) {
+	var c counters
+	c.observeLookup(time.Millisecond, nil)
+	c.observeLookup(7*time.Millisecond, fmt.Errorf("err"))
+	c.observeLookup(time.Minute, nil)
+
+	h := c.lookupLatency()
+	if got, want := h.Count, uint64(3); got != want {
+		t.Fatalf("want count %d, got %d", want, got)
+	}
+	if got, want := h.Sum, time.Minute+8*time.Millisecond; got != want {
+		t.Fatalf("want sum %v, got %v", want, got)
+	}
+	// 1ms <= 1ms, 7ms <= 10ms, 1m is above all bounds.
+	if got, want := h.Buckets[0], uint64(1); got != want {
+		t.Fatalf("want %d in first bucket, got %d", want, got)
+	}
+	if got, want := h.Buckets[2], uint64(2); got != want {
+		t.Fatalf("want %d in 10ms bucket, got %d", want, got)
+	}
+	if got, want := h.Buckets[len(h.Buckets)-1], uint64(2); got != want {
+		t.Fatalf("want %d in last bucket, got %d", want, got)
+	}
+	if got, want := c.lookupErrors.Load(), uint64(1); got != want {
+		t.Fatalf("want %d errors, got %d", want, got)
+	}
+}
+
+// expvarSeq makes the names of the expvar variables published by the tests unique.
+var expvarSeq atomic.Int64
+
+func TestPublishExpvar(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if host == "fail.jp" {
+			return nil, 0, fmt.Errorf("err")
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	ctx := context.Background()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	// The name must be unique per run since an expvar variable can not be unpublished.
+	name := fmt.Sprintf("%s_%d", t.Name(), expvarSeq.Add(1))
+	if err := resolver.PublishExpvar(name); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := resolver.PublishExpvar(name); err == nil {
+		t.Fatalf("expect the duplicate name to fail")
+	}
+
+	for _, host := range []string{"a.jp", "a.jp", "fail.jp"} {
+		_, _ = resolver.Fetch(ctx, host)
+	}
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("expect the variable to be published")
+	}
+	var got map[string]int
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := map[string]int{
+		"cache_hits":        1,
+		"cache_misses":      2,
+		"refresh_successes": 0,
+		"refresh_failures":  0,
+		"lookups":           2,
+		"lookup_errors":     1,
+		"ip_set_changes":    0,
+		"entries":           1,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestHostStats(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var fail atomic.Bool
+	lookupErr := errors.New("err")
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if fail.Load() {
+			return nil, 0, lookupErr
+		}
+		return []net.IPAddr{{IP: net.IP("10.0.0.1")}}, 0, nil
+	}
+
+	resolver, err := New(time.Hour, testDefaultLookupTimeout)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "flappy.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got := resolver.HostStats("flappy.jp"); got != (HostStats{}) {
+		t.Fatalf("expect no failure, got %+v", got)
+	}
+
+	fail.Store(true)
+	for i := 0; i < 3; i++ {
+		resolver.Refresh()
+	}
+	got := resolver.HostStats("FLAPPY.jp.")
+	if got.ConsecutiveFailures != 3 || got.TotalFailures != 3 || !errors.Is(got.LastError, lookupErr) {
+		t.Fatalf("want 3 consecutive failures of %v, got %+v", lookupErr, got)
+	}
+
+	// The success resets the consecutive failures only.
+	fail.Store(false)
+	resolver.Refresh()
+	fail.Store(true)
+	resolver.Refresh()
+	got = resolver.HostStats("flappy.jp")
+	if got.ConsecutiveFailures != 1 || got.TotalFailures != 4 || !errors.Is(got.LastError, lookupErr) {
+		t.Fatalf("want 1 consecutive and 4 total failures, got %+v", got)
+	}
+}
+
+func TestChurn(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var current atomic.Value
+	current.Store("10.0.0.1")
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.ParseIP(current.Load().(string))}}, 0, nil
+	}
+
+	var churned []int
+	resolver, err := New(time.Hour, testDefaultLookupTimeout, WithOnChurn(2, func(host string, changes int) {
+		if host != "flappy.jp" {
+			t.Errorf("want flappy.jp, got %s", host)
+		}
+		churned = append(churned, changes)
+	}))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	ctx := context.Background()
+	if _, err := resolver.Fetch(ctx, "flappy.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the lookups returning the different IP set count.
+	for _, ip := range []string{"10.0.0.2", "10.0.0.2", "10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		current.Store(ip)
+		if err := resolver.RefreshHost(ctx, "flappy.jp"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if got := resolver.Stats().IPSetChanges; got != 3 {
+		t.Fatalf("want 3 changes, got %d", got)
+	}
+	if want := []int{2, 3}; !reflect.DeepEqual(want, churned) {
+		t.Fatalf("want %v, got %v", want, churned)
+	}
+
+	// The refresh starts a new window, while the total keeps counting.
+	churned = nil
+	current.Store("10.0.0.1")
+	resolver.Refresh()
+	if churned != nil {
+		t.Fatalf("expect no churn in the new window, got %v", churned)
+	}
+	if got := resolver.Stats().IPSetChanges; got != 4 {
+		t.Fatalf("want 4 changes, got %d", got)
+	}
+}
@@ -0,0 +1,247 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// Store is the storage of the cache entries. By default, the resolver keeps the entries
+// in sharded maps in memory. Implement it to share the entries e.g. by Redis. The resolver
+// calls its methods from multiple goroutines at once, e.g. `Fetch` and the refresh, so
+// they must be safe for concurrent use, as well as when the store is shared by multiple
+// resolvers. Since an entry can be shared by multiple resolvers, it must not be modified.
+type Store interface {
+	// Get returns the entry of the given host. It reports whether the entry exists.
+	Get(host string) (*Entry, bool)
+
+	// Set saves the entry of the given host, replacing the existing one.
+	Set(host string, entry *Entry)
+
+	// Delete removes the entry of the given host. It does nothing if it does not exist.
+	Delete(host string)
+
+	// Keys returns all hosts which have entries.
+	Keys() []string
+
+	// Len returns the number of hosts which have entries.
+	Len() int
+}
+
+// cacheShards is the number of the shards of the default store.
+const cacheShards = 32
+
+// shardedStore is the default Store which splits the entries into the shards keyed
+// by the hash of the host, each guarded by its own lock. Unlike the other stores, the
+// resolver reads it without its own lock, so the parallel reads of different hosts do not
+// contend on one lock.
+type shardedStore []*storeShard
+
+// storeShard is a shard of shardedStore.
+type storeShard struct {
+	mu      sync.RWMutex
+	entries map[string]*Entry
+}
+
+// newShardedStore returns a shardedStore of the given number of shards.
+func newShardedStore(shards int) shardedStore {
+	s := make(shardedStore, shards)
+	for i := range s {
+		s[i] = &storeShard{entries: make(map[string]*Entry, cacheSize/shards+1)}
+	}
+	return s
+}
+
+// shard returns the shard of the given host, chosen by the FNV-1a hash of the host.
+// The hash is computed inline not to allocate `hash.Hash32` on every read.
+func (s shardedStore) shard(host string) *storeShard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(host); i++ {
+		h ^= uint32(host[i])
+		h *= prime32
+	}
+	return s[h%uint32(len(s))]
+}
+
+func (s shardedStore) Get(host string) (*Entry, bool) {
+	shard := s.shard(host)
+	shard.mu.RLock()
+	entry, ok := shard.entries[host]
+	shard.mu.RUnlock()
+	return entry, ok
+}
+
+func (s shardedStore) Set(host string, entry *Entry) {
+	shard := s.shard(host)
+	shard.mu.Lock()
+	shard.entries[host] = entry
+	shard.mu.Unlock()
+}
+
+func (s shardedStore) Delete(host string) {
+	shard := s.shard(host)
+	shard.mu.Lock()
+	delete(shard.entries, host)
+	shard.mu.Unlock()
+}
+
+func (s shardedStore) Keys() []string {
+	var keys []string
+	s.forEach(func(host string, _ *Entry) {
+		keys = append(keys, host)
+	})
+	return keys
+}
+
+func (s shardedStore) Len() int {
+	var n int
+	for _, shard := range s {
+		shard.mu.RLock()
+		n += len(shard.entries)
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// compact rebuilds the map of each shard sized to its entries, so that the buckets grown
+// for the removed entries are garbage collected.
+func (s shardedStore) compact() {
+	for _, shard := range s {
+		shard.mu.Lock()
+		shard.entries = compactMap(shard.entries)
+		shard.mu.Unlock()
+	}
+}
+
+// compactMap returns a copy of the given map sized to its entries.
+func compactMap[V any](m map[string]V) map[string]V {
+	compacted := make(map[string]V, len(m))
+	for k, v := range m {
+		compacted[k] = v
+	}
+	return compacted
+}
+
+// forEach calls fn for each entry. The entries of each shard are copied before fn is
+// called, so fn can modify the store.
+func (s shardedStore) forEach(fn func(host string, entry *Entry)) {
+	type pair struct {
+		host  string
+		entry *Entry
+	}
+	var pairs []pair
+	for _, shard := range s {
+		pairs = pairs[:0]
+		shard.mu.RLock()
+		for host, entry := range shard.entries {
+			pairs = append(pairs, pair{host, entry})
+		}
+		shard.mu.RUnlock()
+		for _, p := range pairs {
+			fn(p.host, p.entry)
+		}
+	}
+}
+
+// getEntry returns the cached entry of the given addr. It takes the lock only if
+// the store is not safe for concurrent use.
+func (r *Resolver) getEntry(addr string) (*Entry, bool) {
+	if s, ok := r.cache.(shardedStore); ok {
+		return s.Get(addr)
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cache.Get(addr)
+}
+
+// forEachEntry calls fn for each entry in the cache. The caller must hold the lock.
+func (r *Resolver) forEachEntry(fn func(addr string, entry *Entry)) {
+	if s, ok := r.cache.(shardedStore); ok {
+		s.forEach(fn)
+		return
+	}
+	for _, addr := range r.cache.Keys() {
+		if entry, ok := r.cache.Get(addr); ok {
+			fn(addr, entry)
+		}
+	}
+}
+
+// entryJSON is the JSON representation of Entry. It is also the format of the entries
+// saved by `SaveToFile`.
+type entryJSON struct {
+	IPs           []net.IP  `json:"ips"`
+	ExpireAt      time.Time `json:"expire_at,omitempty"`
+	Static        bool      `json:"static,omitempty"`
+	RefreshedAt   time.Time `json:"refreshed_at,omitempty"`
+	CanonicalName string    `json:"canonical_name,omitempty"`
+	Invalidated   bool      `json:"invalidated,omitempty"`
+
+	// Zones is keyed by the string form of the IPs.
+	Zones map[string]string `json:"zones,omitempty"`
+}
+
+// MarshalJSON implements `json.Marshaler`.
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(entryJSON{
+		IPs:           e.ips,
+		ExpireAt:      e.expireAt,
+		Static:        e.static,
+		RefreshedAt:   e.refreshedAt,
+		CanonicalName: e.canonicalName,
+		Invalidated:   e.invalidated,
+		Zones:         zonesJSON(e.zones),
+	})
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var v entryJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = Entry{
+		ips:           v.IPs,
+		expireAt:      v.ExpireAt,
+		static:        v.Static,
+		refreshedAt:   v.RefreshedAt,
+		canonicalName: v.CanonicalName,
+		invalidated:   v.Invalidated,
+		zones:         parseZonesJSON(v.Zones),
+	}
+	return nil
+}
+
+// zonesJSON converts the zones keyed by ipKey into the ones keyed by the string form
+// of the IPs to serialize them.
+func zonesJSON(zones map[string]string) map[string]string {
+	if len(zones) == 0 {
+		return nil
+	}
+	converted := make(map[string]string, len(zones))
+	for key, zone := range zones {
+		converted[net.IP(key).String()] = zone
+	}
+	return converted
+}
+
+// parseZonesJSON is the inverse of zonesJSON. The keys which are not IPs are ignored.
+func parseZonesJSON(zones map[string]string) map[string]string {
+	var parsed map[string]string
+	for s, zone := range zones {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		if parsed == nil {
+			parsed = make(map[string]string, len(zones))
+		}
+		parsed[ipKey(ip)] = zone
+	}
+	return parsed
+}
@@ -0,0 +1,272 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapStore is a Store which keeps entries in a plain map. It is not safe for concurrent
+// writes, so it is only used by the tests and as the baseline of the benchmarks.
+type mapStore map[string]*Entry
+
+func (s mapStore) Get(host string) (*Entry, bool) {
+	entry, ok := s[host]
+	return entry, ok
+}
+
+func (s mapStore) Set(host string, entry *Entry) {
+	s[host] = entry
+}
+
+func (s mapStore) Delete(host string) {
+	delete(s, host)
+}
+
+func (s mapStore) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for host := range s {
+		keys = append(keys, host)
+	}
+	return keys
+}
+
+func (s mapStore) Len() int {
+	return len(s)
+}
+
+// fakeStore is a Store which keeps entries serialized as JSON like a remote store.
+type fakeStore struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{entries: make(map[string][]byte)}
+}
+
+func (s *fakeStore) Get(host string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.entries[host]
+	if !ok {
+		return nil, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (s *fakeStore) Set(host string, entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+	s.entries[host] = data
+}
+
+func (s *fakeStore) Delete(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, host)
+}
+
+func (s *fakeStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.entries))
+	for host := range s.entries {
+		keys = append(keys, host)
+	}
+	return keys
+}
+
+func (s *fakeStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func TestWithStore(t *testing.T) {
+	originalFunc := lookupIP
+	defer func() {
+		lookupIP = originalFunc
+	}()
+
+	var (
+		mu     sync.Mutex
+		called = make(map[string]int)
+	)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		mu.Lock()
+		called[host]++
+		mu.Unlock()
+		return []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}, time.Hour, nil
+	}
+
+	store := newFakeStore()
+	resolver, err := New(time.Hour, testDefaultLookupTimeout,
+		WithStaticEntries(map[string][]net.IP{
+			"static.jp": {net.IPv4(10, 0, 0, 2)},
+		}),
+		WithStore(store),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Fetch(context.Background(), "store.jp"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	keys := store.Keys()
+	sort.Strings(keys)
+	if want := []string{"static.jp", "store.jp"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("want keys %v, got %v", want, keys)
+	}
+
+	// Another resolver sharing the store uses the cached entries.
+	other, err := New(time.Hour, testDefaultLookupTimeout, WithStore(store))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer other.Stop()
+
+	got, err := other.Fetch(context.Background(), "store.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 1)}; !reflect.DeepEqual(normalizeIPs(got), want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	got, err = other.LookupIP(context.Background(), "static.jp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 2)}; !reflect.DeepEqual(normalizeIPs(got), want) {
+		t.Fatalf("want static entry %v, got %v", want, got)
+	}
+	if called["store.jp"] != 1 {
+		t.Fatalf("expect the shared entry to be used, looked up %d times", called["store.jp"])
+	}
+
+	resolver.Clear()
+	if keys := store.Keys(); !reflect.DeepEqual(keys, []string{"static.jp"}) {
+		t.Fatalf("expect only static entry to be kept, got %v", keys)
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	resolver := &Resolver{
+		cache: newShardedStore(cacheShards),
+	}
+	for i := 0; i < 100; i++ {
+		resolver.cache.Set(fmt.Sprintf("host%d.jp", i), &Entry{ips: []net.IP{net.IPv4(10, 0, 0, byte(i))}})
+	}
+	resolver.cache.Set("static.jp", &Entry{ips: []net.IP{net.IPv4(10, 0, 1, 1)}, static: true})
+
+	if got := resolver.Len(); got != 101 {
+		t.Fatalf("want 101 entries, got %d", got)
+	}
+	entries := resolver.Entries()
+	if len(entries) != 101 {
+		t.Fatalf("want 101 entries, got %d", len(entries))
+	}
+	if want := []net.IP{net.IPv4(10, 0, 0, 42)}; !reflect.DeepEqual(entries["host42.jp"], want) {
+		t.Fatalf("want %v, got %v", want, entries["host42.jp"])
+	}
+
+	resolver.Clear()
+	if keys := resolver.cache.Keys(); !reflect.DeepEqual(keys, []string{"static.jp"}) {
+		t.Fatalf("expect only static entry to be kept, got %v", keys)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	stores := []struct {
+		name  string
+		store Store
+	}{
+		{"sharded", newShardedStore(cacheShards)},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			resolver := &Resolver{
+				cache: s.store,
+			}
+			for i := 0; i < 10000; i++ {
+				resolver.cache.Set(fmt.Sprintf("host%d.jp", i), &Entry{ips: []net.IP{net.IPv4(10, 0, byte(i>>8), byte(i))}})
+			}
+			for i := 10; i < 10000; i++ {
+				resolver.Remove(fmt.Sprintf("host%d.jp", i))
+			}
+
+			resolver.Compact()
+
+			entries := resolver.Entries()
+			if len(entries) != 10 {
+				t.Fatalf("expect 10 entries to be kept, got %d", len(entries))
+			}
+			for i := 0; i < 10; i++ {
+				host := fmt.Sprintf("host%d.jp", i)
+				if want := []net.IP{net.IPv4(10, 0, 0, byte(i))}; !reflect.DeepEqual(entries[host], want) {
+					t.Fatalf("%s: want %v, got %v", host, want, entries[host])
+				}
+			}
+
+			// The compacted cache keeps working.
+			resolver.cache.Set("new.jp", &Entry{ips: []net.IP{net.IPv4(10, 0, 0, 42)}})
+			if ips, ok := resolver.Peek("new.jp"); !ok || !ips[0].Equal(net.IPv4(10, 0, 0, 42)) {
+				t.Fatalf("expect new entry to be cached, got %v", ips)
+			}
+		})
+	}
+}
+
+func BenchmarkFetchParallel(b *testing.B) {
+	stores := []struct {
+		name  string
+		store Store
+	}{
+		{"map", make(mapStore)},
+		{"sharded", newShardedStore(cacheShards)},
+	}
+
+	hosts := make([]string, 64)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d.jp", i)
+	}
+
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			resolver := &Resolver{
+				cache: s.store,
+			}
+			for _, host := range hosts {
+				resolver.cache.Set(host, &Entry{ips: []net.IP{net.IPv4(10, 0, 0, 1)}})
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				for i := 0; pb.Next(); i++ {
+					if _, err := resolver.Fetch(ctx, hosts[i%len(hosts)]); err != nil {
+						b.Fatalf("err: %s", err)
+					}
+				}
+			})
+		})
+	}
+}